@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// accessLogConfig selects where and how the access log is written.
+type accessLogConfig struct {
+	// Output is stdout, stderr, off or the path of a file rotated by size.
+	Output string
+	// Format is combined or json.
+	Format string
+
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+}
+
+func accessLogConfigFromEnv() (accessLogConfig, error) {
+	config := accessLogConfig{
+		Output:     envString("ACCESS_LOG", "stdout"),
+		Format:     envString("ACCESS_LOG_FORMAT", "combined"),
+		MaxSizeMB:  100,
+		MaxBackups: 5,
+		MaxAgeDays: 30,
+	}
+
+	var err error
+	if config.MaxSizeMB, err = envInt("ACCESS_LOG_MAX_SIZE_MB", config.MaxSizeMB); err != nil {
+		return config, err
+	}
+	if config.MaxBackups, err = envInt("ACCESS_LOG_MAX_BACKUPS", config.MaxBackups); err != nil {
+		return config, err
+	}
+	if config.MaxAgeDays, err = envInt("ACCESS_LOG_MAX_AGE_DAYS", config.MaxAgeDays); err != nil {
+		return config, err
+	}
+
+	if config.Format != "combined" && config.Format != "json" {
+		return config, fmt.Errorf("invalid ACCESS_LOG_FORMAT %q, must be combined or json", config.Format)
+	}
+	if config.MaxSizeMB < 1 || config.MaxBackups < 0 || config.MaxAgeDays < 0 {
+		return config, fmt.Errorf("invalid access log rotation settings")
+	}
+	return config, nil
+}
+
+// accessLogger writes one line per proxied request.
+type accessLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+}
+
+// accessLog is the access log of the running service, nil when disabled.
+var accessLog *accessLogger
+
+func newAccessLogger(config accessLogConfig) *accessLogger {
+	var out io.Writer
+	switch config.Output {
+	case "off", "":
+		return nil
+	case "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		out = &lumberjack.Logger{
+			Filename:   config.Output,
+			MaxSize:    config.MaxSizeMB,
+			MaxBackups: config.MaxBackups,
+			MaxAge:     config.MaxAgeDays,
+			Compress:   true,
+		}
+	}
+	return &accessLogger{out: out, format: config.Format}
+}
+
+func (l *accessLogger) close() error {
+	if l == nil {
+		return nil
+	}
+	if closer, ok := l.out.(io.Closer); ok && closer != os.Stdout && closer != os.Stderr {
+		return closer.Close()
+	}
+	return nil
+}
+
+// accessEntry is a line of the access log.
+type accessEntry struct {
+	Time              time.Time `json:"time"`
+	RemoteIP          string    `json:"remote_ip"`
+	Client            string    `json:"client"`
+	ClientID          string    `json:"client_id,omitempty"`
+	Method            string    `json:"method"`
+	URI               string    `json:"uri"`
+	Protocol          string    `json:"protocol"`
+	Status            int       `json:"status"`
+	Bytes             int64     `json:"bytes"`
+	Referer           string    `json:"referer,omitempty"`
+	UserAgent         string    `json:"user_agent,omitempty"`
+	Route             string    `json:"route"`
+	RequestID         string    `json:"request_id,omitempty"`
+	DurationMS        float64   `json:"duration_ms"`
+	UpstreamStatus    int       `json:"upstream_status,omitempty"`
+	UpstreamLatencyMS float64   `json:"upstream_latency_ms,omitempty"`
+}
+
+func (l *accessLogger) write(entry accessEntry) {
+	var line []byte
+	if l.format == "json" {
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	} else {
+		line = []byte(combinedLine(entry))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(line)
+}
+
+// combinedLine formats the entry in the NCSA combined log format, followed
+// by the fields specific to the proxy.
+func combinedLine(e accessEntry) string {
+	upstreamStatus := "-"
+	if e.UpstreamStatus != 0 {
+		upstreamStatus = strconv.Itoa(e.UpstreamStatus)
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %d %d %q %q route=%s request_id=%s duration_ms=%.3f upstream_status=%s upstream_latency_ms=%.3f\n",
+		dash(e.RemoteIP),
+		dash(e.Client),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+e.URI+" "+e.Protocol,
+		e.Status,
+		e.Bytes,
+		dash(e.Referer),
+		dash(e.UserAgent),
+		e.Route,
+		dash(e.RequestID),
+		e.DurationMS,
+		upstreamStatus,
+		e.UpstreamLatencyMS,
+	)
+}
+
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// upstreamResult is filled by redirect with the outcome of the upstream
+// call, for the access log.
+type upstreamResult struct {
+	status  int
+	latency time.Duration
+}
+
+type upstreamResultKey struct{}
+
+func upstreamResultFrom(ctx context.Context) *upstreamResult {
+	if result, ok := ctx.Value(upstreamResultKey{}).(*upstreamResult); ok {
+		return result
+	}
+	return &upstreamResult{}
+}
+
+// accessLogs writes an access log line for every request once answered.
+func accessLogs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if accessLog == nil {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		start := time.Now()
+		proxy := proxyConfigFrom(request.Context())
+		c := identify(request)
+		result := &upstreamResult{}
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, request.WithContext(context.WithValue(request.Context(), upstreamResultKey{}, result)))
+
+		accessLog.write(accessEntry{
+			Time:              start,
+			RemoteIP:          proxy.clientIP(request),
+			Client:            c.Name,
+			ClientID:          c.ID,
+			Method:            request.Method,
+			URI:               redactedURI(request.URL),
+			Protocol:          request.Proto,
+			Status:            recorder.status,
+			Bytes:             recorder.written,
+			Referer:           request.Referer(),
+			UserAgent:         request.UserAgent(),
+			Route:             proxy.match(request).Name,
+			RequestID:         requestIDFrom(request.Context()),
+			DurationMS:        milliseconds(time.Since(start)),
+			UpstreamStatus:    result.status,
+			UpstreamLatencyMS: milliseconds(result.latency),
+		})
+	})
+}
+
+// redactedURI returns the path and query of the URL with the api-key
+// parameter hidden.
+func redactedURI(u *url.URL) string {
+	uri := u.EscapedPath()
+	if u.RawQuery == "" {
+		return uri
+	}
+
+	parts := strings.Split(u.RawQuery, "&")
+	for i, part := range parts {
+		key, _, _ := strings.Cut(part, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == "api-key" {
+			parts[i] = key + "=REDACTED"
+		}
+	}
+	return uri + "?" + strings.Join(parts, "&")
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
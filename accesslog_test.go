@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// recordAccessLog sends the access log to a buffer for the rest of the test.
+func recordAccessLog(t *testing.T, format string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	accessLog = &accessLogger{out: buf, format: format}
+	t.Cleanup(func() { accessLog = nil })
+	return buf
+}
+
+func TestAccessLogCombined(t *testing.T) {
+
+	// Create a test server that returns a predefined response
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("accepted"))
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv("TOKEN", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := recordAccessLog(t, "combined")
+
+	req := httptest.NewRequest("GET", "/wallets/1?api-key=94a08da1fecbb6e8b46990538c7b50b2&page=2", nil)
+	req.Header.Set("User-Agent", "wallet-app/1.0")
+	req.Header.Set(requestIDHeader, "wallet-app-4f1c2a")
+	newMux().ServeHTTP(httptest.NewRecorder(), req)
+
+	line := logs.String()
+	pattern := regexp.MustCompile(`^192\.0\.2\.1 - token \[[^\]]+\] "GET /wallets/1\?api-key=REDACTED&page=2 HTTP/1\.1" 202 8 "-" "wallet-app/1\.0" ` +
+		`route=default request_id=wallet-app-4f1c2a duration_ms=[0-9.]+ upstream_status=202 upstream_latency_ms=[0-9.]+\n$`)
+	if !pattern.MatchString(line) {
+		t.Errorf("unexpected access log line: %q", line)
+	}
+	if strings.Contains(line, "94a08da1fecbb6e8b46990538c7b50b2") {
+		t.Errorf("api key written to the access log")
+	}
+
+}
+
+func TestAccessLogJSON(t *testing.T) {
+
+	err := os.Setenv("REDIRECT_URL", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := recordAccessLog(t, "json")
+
+	req := httptest.NewRequest("POST", "/invoices", strings.NewReader(`{}`))
+	req.Header.Set("X-Api-Key", "secret-key")
+	newMux().ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("access log line is not JSON: %q", logs)
+	}
+	for key, want := range map[string]any{
+		"method":    "POST",
+		"uri":       "/invoices",
+		"status":    float64(http.StatusInternalServerError),
+		"client":    "x-api-key",
+		"client_id": fingerprint("secret-key"),
+		"route":     "default",
+	} {
+		if entry[key] != want {
+			t.Errorf("%s: got %v want %v", key, entry[key], want)
+		}
+	}
+	// the request never reached the upstream
+	if _, ok := entry["upstream_status"]; ok {
+		t.Errorf("unexpected upstream status: %v", entry["upstream_status"])
+	}
+	if strings.Contains(logs.String(), "secret-key") {
+		t.Errorf("api key written to the access log")
+	}
+
+}
+
+func TestRedactedURI(t *testing.T) {
+
+	for raw, want := range map[string]string{
+		"/a":                      "/a",
+		"/a?api-key=secret":       "/a?api-key=REDACTED",
+		"/a?x=1&api%2Dkey=secret": "/a?x=1&api%2Dkey=REDACTED",
+		"/a?api-keys=1":           "/a?api-keys=1",
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := redactedURI(u); got != want {
+			t.Errorf("%s: got %q want %q", raw, got, want)
+		}
+	}
+
+}
+
+func TestAccessLogConfigFromEnv(t *testing.T) {
+
+	t.Setenv("ACCESS_LOG", "off")
+	config, err := accessLogConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newAccessLogger(config) != nil {
+		t.Errorf("access log not disabled")
+	}
+
+	t.Setenv("ACCESS_LOG_FORMAT", "xml")
+	if _, err := accessLogConfigFromEnv(); err == nil {
+		t.Errorf("invalid format accepted")
+	}
+
+}
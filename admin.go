@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// version is the release of the service, set at build time with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// startTime is when the process started, reported by the build info.
+var startTime = time.Now()
+
+// runtimeSettings are the settings read from the environment at startup,
+// reported by the admin API next to the proxy configuration.
+type runtimeSettings struct {
+	Server      serverConfig
+	HealthCheck healthCheckConfig
+	Shutdown    shutdownConfig
+	AccessLog   accessLogConfig
+	AuditLog    string
+}
+
+// newAdminMux routes the endpoints of the admin listener, which is meant
+// for operators and is never exposed through the ingress. The probes and
+// the metrics are open, the inspection endpoints require ADMIN_TOKEN.
+func newAdminMux(settings runtimeSettings) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(livenessPath, healthz)
+	mux.HandleFunc(readinessPath, readyz)
+	mux.Handle(metricsPath, metricsHandler())
+	mux.Handle("/upstreams", adminAuth(http.HandlerFunc(upstreams)))
+	mux.Handle("/config", adminAuth(effectiveConfig(settings)))
+	mux.Handle("/routes", adminAuth(http.HandlerFunc(routeTable)))
+	mux.Handle("/keys", adminAuth(http.HandlerFunc(activeKeys)))
+	mux.Handle("/build", adminAuth(http.HandlerFunc(buildInfo)))
+	return mux
+}
+
+// adminAuth only lets through requests carrying ADMIN_TOKEN as a bearer
+// token. The endpoints are disabled while ADMIN_TOKEN is not set.
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		token := currentProxyConfig().secret("ADMIN_TOKEN")
+		if token == "" {
+			http.Error(writer, "Admin API disabled, ADMIN_TOKEN is not set", http.StatusForbidden)
+			return
+		}
+
+		presented, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// upstreams lists the health of every upstream target.
+func upstreams(writer http.ResponseWriter, request *http.Request) {
+	statuses := checker.statuses()
+	if statuses == nil {
+		statuses = []targetStatus{}
+	}
+	writeJSON(writer, http.StatusOK, statuses)
+}
+
+// effectiveConfig reports the configuration in use, with the secrets
+// replaced by whether they are set.
+func effectiveConfig(settings runtimeSettings) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		server := settings.Server
+		proxy := currentProxyConfig()
+		writeJSON(writer, http.StatusOK, map[string]any{
+			"server": map[string]any{
+				"listen":              server.Listen,
+				"admin_listen":        server.AdminListen,
+				"config_file":         server.ConfigFile,
+				"log_level":           server.LogLevel,
+				"log_format":          server.LogFormat,
+				"read_header_timeout": duration(server.ReadHeaderTimeout),
+				"read_timeout":        duration(server.ReadTimeout),
+				"write_timeout":       duration(server.WriteTimeout),
+				"idle_timeout":        duration(server.IdleTimeout),
+			},
+			"upstream": map[string]any{
+				"redirect_url": redactedURL(proxy.redirectURL()),
+				"token":        secretSet(proxy, "TOKEN"),
+				"x_api_key":    secretSet(proxy, "X_API_KEY"),
+			},
+			"admin_token": secretSet(proxy, "ADMIN_TOKEN"),
+			"health_check": map[string]any{
+				"path":                settings.HealthCheck.Path,
+				"expected_status":     settings.HealthCheck.ExpectedStatus,
+				"interval":            duration(settings.HealthCheck.Interval),
+				"timeout":             duration(settings.HealthCheck.Timeout),
+				"healthy_threshold":   settings.HealthCheck.HealthyThreshold,
+				"unhealthy_threshold": settings.HealthCheck.UnhealthyThreshold,
+			},
+			"shutdown": map[string]any{
+				"delay":         duration(settings.Shutdown.Delay),
+				"drain_timeout": duration(settings.Shutdown.DrainTimeout),
+			},
+			"access_log": map[string]any{
+				"output":       settings.AccessLog.Output,
+				"format":       settings.AccessLog.Format,
+				"max_size_mb":  settings.AccessLog.MaxSizeMB,
+				"max_backups":  settings.AccessLog.MaxBackups,
+				"max_age_days": settings.AccessLog.MaxAgeDays,
+			},
+			"audit_log": redactedURL(settings.AuditLog),
+			"proxy":     redactedProxyConfig(proxy),
+		})
+	}
+}
+
+// secretSet reports whether the secret is set, without revealing it.
+func secretSet(proxy *proxyConfig, name string) string {
+	if proxy.secret(name) == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
+// redactedURL hides the credentials and the query of a URL, values that
+// aren't absolute URLs are returned unchanged.
+func redactedURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	return u.String()
+}
+
+// redactedProxyConfig returns a copy of the configuration without its
+// upstream credentials and without the values of the headers it adds,
+// which may carry static upstream credentials.
+func redactedProxyConfig(c *proxyConfig) *proxyConfig {
+	redacted := *c
+	redacted.RedirectURL = redactedURL(c.RedirectURL)
+	redacted.Headers = redactedHeaderPolicy(c.Headers)
+	redacted.Routes = make([]*route, len(c.Routes))
+	for i, r := range c.Routes {
+		copied := *r
+		copied.Headers = redactedHeaderPolicy(r.Headers)
+		redacted.Routes[i] = &copied
+	}
+	return &redacted
+}
+
+func redactedHeaderPolicy(p *headerPolicy) *headerPolicy {
+	if p == nil {
+		return nil
+	}
+	redacted := *p
+	redacted.Add = redactedValues(p.Add)
+	redacted.Set = redactedValues(p.Set)
+	if p.Response != nil {
+		response := *p.Response
+		response.Add = redactedValues(p.Response.Add)
+		response.Set = redactedValues(p.Response.Set)
+		redacted.Response = &response
+	}
+	return &redacted
+}
+
+func redactedValues(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(headers))
+	for name := range headers {
+		redacted[name] = "REDACTED"
+	}
+	return redacted
+}
+
+// routeEntry is a route with the limits that apply to it once the global
+// settings are taken into account.
+type routeEntry struct {
+	Name         string            `json:"name"`
+	Path         string            `json:"path"`
+	Methods      []string          `json:"methods,omitempty"`
+	MaxBodyBytes int64             `json:"max_body_bytes"`
+	RateLimits   rateLimits        `json:"rate_limits"`
+	Concurrency  *concurrencyLimit `json:"concurrency,omitempty"`
+	InFlight     *concurrencyStats `json:"in_flight,omitempty"`
+}
+
+// routeTable lists the configured routes followed by the default route,
+// which answers the requests no other route matches.
+func routeTable(writer http.ResponseWriter, request *http.Request) {
+	proxy := currentProxyConfig()
+	stats := limiters.stats()
+
+	var entries []routeEntry
+	for _, r := range append(append([]*route{}, proxy.Routes...), defaultRoute) {
+		entry := routeEntry{
+			Name:         r.Name,
+			Path:         r.Path,
+			Methods:      r.Methods,
+			MaxBodyBytes: proxy.maxBodyBytes(r),
+			RateLimits:   proxy.rateLimits(r),
+			Concurrency:  proxy.concurrencyLimit(r),
+		}
+		if s, ok := stats[r.Name]; ok {
+			entry.InFlight = &s
+		}
+		entries = append(entries, entry)
+	}
+	writeJSON(writer, http.StatusOK, entries)
+}
+
+// keyEntry identifies a configured key by the fingerprint the logs use.
+type keyEntry struct {
+	ID string `json:"id"`
+	// Use is token for the key accepted in the api-key parameter and
+	// upstream for the key sent to the upstream.
+	Use string `json:"use"`
+}
+
+// activeKeys lists the fingerprints of the keys in use.
+func activeKeys(writer http.ResponseWriter, request *http.Request) {
+	proxy := currentProxyConfig()
+	keys := []keyEntry{}
+	if token := proxy.secret("TOKEN"); token != "" {
+		// clients present the md5 of the token, see validateApiKey
+		keys = append(keys, keyEntry{ID: fingerprint(fmt.Sprintf("%x", md5.Sum([]byte(token)))), Use: "token"})
+	}
+	if key := proxy.secret("X_API_KEY"); key != "" {
+		keys = append(keys, keyEntry{ID: fingerprint(key), Use: "upstream"})
+	}
+	writeJSON(writer, http.StatusOK, keys)
+}
+
+// buildInfo reports the version of the service and how it was built.
+func buildInfo(writer http.ResponseWriter, request *http.Request) {
+	info := map[string]any{
+		"version":    version,
+		"go_version": runtime.Version(),
+		"started_at": startTime.UTC(),
+		"uptime":     duration(time.Since(startTime).Truncate(time.Second)),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info["revision"] = setting.Value
+			case "vcs.time":
+				info["revision_time"] = setting.Value
+			case "vcs.modified":
+				info["modified"] = setting.Value == "true"
+			}
+		}
+	}
+	writeJSON(writer, http.StatusOK, info)
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(value)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditEvent is an entry of the audit log, recording an authentication
+// decision. Entries are chained: Hash covers the entry and the hash of the
+// previous one, so removing or editing an entry breaks the chain. An entry
+// the sink accepted but couldn't deliver is named by a later gap entry,
+// so its loss can be told from tampering.
+type auditEvent struct {
+	Time      time.Time `json:"time"`
+	Seq       uint64    `json:"seq"`
+	RequestID string    `json:"request_id,omitempty"`
+	Client    string    `json:"client"`
+	ClientID  string    `json:"client_id,omitempty"`
+	RemoteIP  string    `json:"remote_ip"`
+	Route     string    `json:"route"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Decision  string    `json:"decision"`
+	Reason    string    `json:"reason"`
+	// LostSeq and LostHash name the undelivered entry of a gap entry.
+	LostSeq  uint64 `json:"lost_seq,omitempty"`
+	LostHash string `json:"lost_hash,omitempty"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// hash returns the hash of the entry, computed over its JSON encoding
+// without the hash itself.
+func (e auditEvent) hash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditSink receives the entries of the audit log in order. Other
+// destinations can be plugged in by implementing this interface.
+type auditSink interface {
+	write(line []byte) error
+	close() error
+}
+
+// auditLogger chains the audit entries and hands them to the sink.
+type auditLogger struct {
+	mu       sync.Mutex
+	sink     auditSink
+	seq      uint64
+	lastHash string
+}
+
+// auditLog is the audit log of the running service, nil when disabled.
+var auditLog *auditLogger
+
+// newAuditLogger opens the audit sink named by output: off, stdout,
+// stderr, an http(s) URL receiving the entries as webhooks or the path of
+// a file. An existing file is verified and its chain continued.
+func newAuditLogger(output string) (*auditLogger, error) {
+	switch {
+	case output == "off" || output == "":
+		return nil, nil
+	case output == "stdout":
+		return &auditLogger{sink: writerSink{os.Stdout}}, nil
+	case output == "stderr":
+		return &auditLogger{sink: writerSink{os.Stderr}}, nil
+	case strings.HasPrefix(output, "http://") || strings.HasPrefix(output, "https://"):
+		logger := &auditLogger{}
+		logger.sink = newWebhookSink(output, logger.recordLoss)
+		return logger, nil
+	}
+
+	logger := &auditLogger{}
+	existing, err := os.Open(output)
+	if err == nil {
+		last, err := verifyAuditLog(existing)
+		_ = existing.Close()
+		if err != nil {
+			return nil, fmt.Errorf("audit log %s: %v", output, err)
+		}
+		logger.seq, logger.lastHash = last.Seq, last.Hash
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	logger.sink = writerSink{file}
+	return logger, nil
+}
+
+func (l *auditLogger) close() error {
+	if l == nil {
+		return nil
+	}
+	return l.sink.close()
+}
+
+// record appends an entry for the authentication decision taken on the
+// request. reason is empty when the credentials were accepted.
+func (l *auditLogger) record(request *http.Request, proxy *proxyConfig, r *route, reason string) {
+	if l == nil {
+		return
+	}
+
+	c := identify(request)
+	event := auditEvent{
+		Time:      time.Now().UTC(),
+		RequestID: requestIDFrom(request.Context()),
+		Client:    c.Name,
+		ClientID:  c.ID,
+		RemoteIP:  proxy.clientIP(request),
+		Route:     r.Name,
+		Method:    request.Method,
+		Path:      request.URL.Path,
+		Decision:  "allow",
+		Reason:    reason,
+	}
+	if reason != "" {
+		event.Decision = "deny"
+	} else {
+		switch c.Name {
+		case "token":
+			event.Reason = "token_valid"
+		case "x-api-key":
+			event.Reason = "x_api_key_forwarded"
+		default:
+			event.Reason = "no_credentials"
+		}
+	}
+
+	l.append(event, loggerFrom(request.Context()))
+}
+
+// recordLoss appends a gap entry naming an entry the sink accepted but
+// failed to deliver. The entry after the lost one chains to its hash, which
+// the gap entry gives, so the chain can still be verified across the hole.
+func (l *auditLogger) recordLoss(line []byte) {
+	var lost auditEvent
+	if err := json.Unmarshal(line, &lost); err != nil {
+		return
+	}
+	l.append(auditEvent{
+		Time:     time.Now().UTC(),
+		Decision: "gap",
+		Reason:   "entry_not_delivered",
+		LostSeq:  lost.Seq,
+		LostHash: lost.Hash,
+	}, slog.Default())
+}
+
+// append chains the entry to the log and hands it to the sink.
+func (l *auditLogger) append(event auditEvent, logger *slog.Logger) {
+	// the lock keeps the sequence, the chain and the order of the sink
+	// consistent
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	event.Seq = l.seq + 1
+	event.PrevHash = l.lastHash
+	event.Hash = event.hash()
+
+	line, _ := json.Marshal(event)
+	if err := l.sink.write(append(line, '\n')); err != nil {
+		auditFailures.Inc()
+		logger.Error("Error writing audit log", "error", err)
+		return
+	}
+	// an entry that wasn't written must not be part of the chain
+	l.seq, l.lastHash = event.Seq, event.Hash
+}
+
+// verifyAuditLog checks the chain of the entries read from r and returns
+// the last one. The first entry may continue the chain of a rotated file.
+// Entries may be missing only when gap entries name every one of them and
+// the last one has the hash the next entry chains to.
+func verifyAuditLog(r io.Reader) (auditEvent, error) {
+	type hole struct {
+		entry       int
+		first, last uint64
+		hash        string
+	}
+	var holes []hole
+	lost := map[uint64]string{}
+
+	var last auditEvent
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return last, fmt.Errorf("entry %d: %v", n, err)
+		}
+		if event.Hash != event.hash() {
+			return last, fmt.Errorf("entry %d: hash mismatch", n)
+		}
+		if n > 1 && (event.PrevHash != last.Hash || event.Seq != last.Seq+1) {
+			if event.Seq <= last.Seq+1 {
+				return last, fmt.Errorf("entry %d: chain broken", n)
+			}
+			// explained or not by the gap entries that follow
+			holes = append(holes, hole{n, last.Seq + 1, event.Seq - 1, event.PrevHash})
+		}
+		if event.LostSeq != 0 {
+			lost[event.LostSeq] = event.LostHash
+		}
+		last = event
+	}
+	if err := scanner.Err(); err != nil {
+		return last, err
+	}
+
+	for _, h := range holes {
+		if h.last-h.first >= uint64(len(lost)) {
+			return last, fmt.Errorf("entry %d: chain broken", h.entry)
+		}
+		for seq := h.first; seq <= h.last; seq++ {
+			if hash, ok := lost[seq]; !ok || seq == h.last && hash != h.hash {
+				return last, fmt.Errorf("entry %d: chain broken", h.entry)
+			}
+		}
+	}
+	return last, nil
+}
+
+// writerSink appends the entries to a stream or a file.
+type writerSink struct {
+	out io.Writer
+}
+
+func (s writerSink) write(line []byte) error {
+	_, err := s.out.Write(line)
+	return err
+}
+
+func (s writerSink) close() error {
+	if file, ok := s.out.(*os.File); ok && file != os.Stdout && file != os.Stderr {
+		return file.Close()
+	}
+	return nil
+}
+
+// webhookQueueSize is the number of entries waiting to be posted before
+// new entries are dropped.
+const webhookQueueSize = 1024
+
+// webhookSink posts every entry as JSON to a URL, in order, from a
+// background goroutine so a slow receiver doesn't hold up the requests.
+// Entries that can't be posted are handed to lost, once they are already
+// part of the chain.
+type webhookSink struct {
+	url     string
+	client  *http.Client
+	queue   chan []byte
+	done    chan struct{}
+	retries int
+	backoff time.Duration
+	lost    func(line []byte)
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newWebhookSink(url string, lost func(line []byte)) *webhookSink {
+	s := &webhookSink{
+		url:     url,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		queue:   make(chan []byte, webhookQueueSize),
+		done:    make(chan struct{}),
+		retries: 3,
+		backoff: time.Second,
+		lost:    lost,
+	}
+	go s.run()
+	return s
+}
+
+func (s *webhookSink) write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("audit webhook closed, entry dropped")
+	}
+	select {
+	case s.queue <- line:
+		return nil
+	default:
+		return fmt.Errorf("audit webhook queue full, entry dropped")
+	}
+}
+
+// close posts the queued entries and stops the sink.
+func (s *webhookSink) close() error {
+	s.mu.Lock()
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
+
+func (s *webhookSink) run() {
+	defer close(s.done)
+	for line := range s.queue {
+		if err := s.post(line); err != nil {
+			auditFailures.Inc()
+			slog.Error("Error posting audit log entry", "error", err)
+			if s.lost != nil {
+				s.lost(line)
+			}
+		}
+	}
+}
+
+func (s *webhookSink) post(line []byte) error {
+	var err error
+	for attempt := 0; attempt < s.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(s.backoff << (attempt - 1))
+		}
+
+		var resp *http.Response
+		resp, err = s.client.Post(s.url, "application/json", bytes.NewReader(line))
+		if err != nil {
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode < http.StatusMultipleChoices {
+			return nil
+		}
+		err = fmt.Errorf("audit webhook answered %s", resp.Status)
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) write(line []byte) error {
+	_, err := s.Write(line)
+	return err
+}
+
+func (s *bufferSink) close() error {
+	return nil
+}
+
+func auditEvents(t *testing.T, data []byte) []auditEvent {
+	var events []auditEvent
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var event auditEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("audit entry is not JSON: %q", line)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAuditLogDecisions(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	t.Setenv("REDIRECT_URL", ts.URL)
+	t.Setenv("TOKEN", "token")
+
+	sink := &bufferSink{}
+	auditLog = &auditLogger{sink: sink}
+	defer func() { auditLog = nil }()
+
+	for _, target := range []string{
+		"/wallets?api-key=94a08da1fecbb6e8b46990538c7b50b2",
+		"/wallets?api-key=wrong",
+		"/wallets",
+	} {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set(requestIDHeader, "audit-test")
+		newMux().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	events := auditEvents(t, sink.Bytes())
+	if len(events) != 3 {
+		t.Fatalf("got %d audit entries, want 3", len(events))
+	}
+	want := []struct{ client, decision, reason string }{
+		{"token", "allow", "token_valid"},
+		{"token", "deny", "invalid_token"},
+		{"anonymous", "allow", "no_credentials"},
+	}
+	for i, event := range events {
+		if event.Client != want[i].client || event.Decision != want[i].decision || event.Reason != want[i].reason {
+			t.Errorf("entry %d: got %s %s %s want %v", i, event.Client, event.Decision, event.Reason, want[i])
+		}
+		if event.Seq != uint64(i+1) || event.RemoteIP != "192.0.2.1" || event.Route != "default" ||
+			event.RequestID != "audit-test" || event.Path != "/wallets" {
+			t.Errorf("entry %d: unexpected fields %+v", i, event)
+		}
+	}
+	if strings.Contains(sink.String(), "94a08da1fecbb6e8b46990538c7b50b2") {
+		t.Errorf("api key written to the audit log")
+	}
+
+	if _, err := verifyAuditLog(bytes.NewReader(sink.Bytes())); err != nil {
+		t.Errorf("chain of the audit log broken: %v", err)
+	}
+
+}
+
+func TestVerifyAuditLogDetectsTampering(t *testing.T) {
+
+	sink := &bufferSink{}
+	logger := &auditLogger{sink: sink}
+	for i := 0; i < 3; i++ {
+		logger.record(httptest.NewRequest("GET", "/wallets?api-key=wrong", nil), &proxyConfig{}, defaultRoute, "invalid_token")
+	}
+	lines := strings.SplitAfter(sink.String(), "\n")
+
+	edited := strings.Replace(sink.String(), `"decision":"deny"`, `"decision":"allow"`, 1)
+	if _, err := verifyAuditLog(strings.NewReader(edited)); err == nil {
+		t.Errorf("edited entry not detected")
+	}
+
+	removed := lines[0] + lines[2]
+	if _, err := verifyAuditLog(strings.NewReader(removed)); err == nil {
+		t.Errorf("removed entry not detected")
+	}
+
+	// a rotated file starts in the middle of the chain
+	last, err := verifyAuditLog(strings.NewReader(lines[1] + lines[2]))
+	if err != nil {
+		t.Errorf("rotated audit log refused: %v", err)
+	}
+	if last.Seq != 3 {
+		t.Errorf("got last entry %d want 3", last.Seq)
+	}
+
+}
+
+func TestAuditLogFileContinuesChain(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	request := httptest.NewRequest("GET", "/wallets", nil)
+
+	for i := 0; i < 2; i++ {
+		logger, err := newAuditLogger(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.record(request, &proxyConfig{}, defaultRoute, "")
+		logger.record(request, &proxyConfig{}, defaultRoute, "")
+		if err := logger.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := verifyAuditLog(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("chain of the audit log broken: %v", err)
+	}
+	if last.Seq != 4 {
+		t.Errorf("got last entry %d want 4", last.Seq)
+	}
+
+	// a tampered file is not appended to
+	if err := os.WriteFile(path, bytes.Replace(data, []byte(`"seq":2`), []byte(`"seq":5`), 1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAuditLogger(path); err == nil {
+		t.Errorf("tampered audit log accepted")
+	}
+
+}
+
+func TestAuditLogWebhook(t *testing.T) {
+
+	var mu sync.Mutex
+	var received [][]byte
+	failures := 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// the first post fails and is retried
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, body)
+	}))
+	defer ts.Close()
+
+	logger, err := newAuditLogger(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.sink.(*webhookSink).backoff = time.Millisecond
+
+	request := httptest.NewRequest("GET", "/wallets", nil)
+	logger.record(request, &proxyConfig{}, defaultRoute, "")
+	logger.record(request, &proxyConfig{}, defaultRoute, "invalid_token")
+	if err := logger.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("got %d webhooks want 2", len(received))
+	}
+	if _, err := verifyAuditLog(bytes.NewReader(bytes.Join(received, nil))); err != nil {
+		t.Errorf("chain of the webhooks broken: %v", err)
+	}
+
+}
+
+func TestAuditLogWebhookRecordsLostEntries(t *testing.T) {
+
+	var mu sync.Mutex
+	var received [][]byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		// the second entry never gets through
+		if bytes.Contains(body, []byte(`"seq":2,`)) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, body)
+	}))
+	defer ts.Close()
+
+	logger, err := newAuditLogger(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.sink.(*webhookSink).retries = 1
+
+	request := httptest.NewRequest("GET", "/wallets", nil)
+	for i := 0; i < 3; i++ {
+		logger.record(request, &proxyConfig{}, defaultRoute, "")
+	}
+	// the gap entry is queued once the post failed
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := logger.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 3 {
+		t.Fatalf("got %d webhooks want 3", len(received))
+	}
+	gap := auditEvents(t, received[2])[0]
+	if gap.Decision != "gap" || gap.LostSeq != 2 {
+		t.Errorf("lost entry not recorded: %+v", gap)
+	}
+	if _, err := verifyAuditLog(bytes.NewReader(bytes.Join(received, nil))); err != nil {
+		t.Errorf("chain with a recorded gap refused: %v", err)
+	}
+	// without the gap entry, the loss can't be told from a removal
+	if _, err := verifyAuditLog(bytes.NewReader(bytes.Join(received[:2], nil))); err == nil {
+		t.Errorf("unrecorded gap accepted")
+	}
+
+}
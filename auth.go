@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// client identifies the caller of a request without holding its key.
+type client struct {
+	// ID is a fingerprint of the presented key, empty for anonymous callers.
+	// The key isn't verified here: x-api-key is only checked by the upstream.
+	ID string
+	// Name describes how the client authenticated.
+	Name string
+}
+
+// identify returns the identity of the caller, based on the same
+// credentials validateApiKey looks at.
+func identify(request *http.Request) client {
+	if apiKey := request.URL.Query().Get("api-key"); apiKey != "" {
+		return client{ID: fingerprint(apiKey), Name: "token"}
+	}
+	if xApiKey := request.Header.Get("x-api-key"); xApiKey != "" {
+		return client{ID: fingerprint(xApiKey), Name: "x-api-key"}
+	}
+	return client{Name: "anonymous"}
+}
+
+// fingerprint returns a short, non reversible identifier of a key.
+func fingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%x", sum[:6])
+}
+
+// clientIP returns the address of the caller. When the connection comes
+// from a trusted proxy the closest untrusted X-Forwarded-For entry is used.
+func (c *proxyConfig) clientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	if !c.trusted(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		host = ip
+		if !c.trusted(ip) {
+			break
+		}
+	}
+	return host
+}
+
+func (c *proxyConfig) trusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range c.trustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdentify(t *testing.T) {
+
+	req := httptest.NewRequest("GET", "/redirect?api-key=secret", nil)
+	req.Header.Set("X-Api-Key", "other")
+	c := identify(req)
+	if c.Name != "token" || c.ID != fingerprint("secret") {
+		t.Errorf("unexpected client: %+v", c)
+	}
+	if strings.Contains(c.ID, "secret") {
+		t.Errorf("client ID holds the key")
+	}
+
+	req = httptest.NewRequest("GET", "/redirect", nil)
+	req.Header.Set("X-Api-Key", "other")
+	if c := identify(req); c.Name != "x-api-key" || c.ID != fingerprint("other") {
+		t.Errorf("unexpected client: %+v", c)
+	}
+
+	if c := identify(httptest.NewRequest("GET", "/redirect", nil)); c.Name != "anonymous" || c.ID != "" {
+		t.Errorf("unexpected client: %+v", c)
+	}
+
+}
+
+func TestClientIP(t *testing.T) {
+
+	config := &proxyConfig{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		// untrusted peers can't choose their address
+		{"203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		// spoofed entries before the last untrusted hop are ignored
+		{"10.1.2.3:1234", "1.1.1.1, 198.51.100.7, 192.0.2.1", "198.51.100.7"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "garbage", "10.1.2.3"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := config.clientIP(req); got != tc.want {
+			t.Errorf("%s via %q: got %q want %q", tc.remote, tc.forwarded, got, tc.want)
+		}
+	}
+
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// bitcoinAddressNetwork checks the checksum of a legacy base58 or a segwit
+// bech32 address and returns the network it belongs to: mainnet, testnet
+// or regtest.
+func bitcoinAddressNetwork(address string) (string, error) {
+	lower := strings.ToLower(address)
+	for prefix, network := range map[string]string{"bc1": "mainnet", "tb1": "testnet", "bcrt1": "regtest"} {
+		if strings.HasPrefix(lower, prefix) {
+			return network, checkSegwitAddress(address, strings.TrimSuffix(prefix, "1"))
+		}
+	}
+	return base58AddressNetwork(address)
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// base58AddressNetwork checks a P2PKH or P2SH address.
+func base58AddressNetwork(address string) (string, error) {
+	if len(address) < 26 || len(address) > 35 {
+		return "", fmt.Errorf("invalid length")
+	}
+
+	value := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range address {
+		digit := strings.IndexRune(base58Alphabet, c)
+		if digit < 0 {
+			return "", fmt.Errorf("invalid character %q", c)
+		}
+		value.Mul(value, radix)
+		value.Add(value, big.NewInt(int64(digit)))
+	}
+
+	// every leading 1 stands for a zero byte
+	decoded := value.Bytes()
+	for i := 0; i < len(address) && address[i] == '1'; i++ {
+		decoded = append([]byte{0}, decoded...)
+	}
+	if len(decoded) != 25 {
+		return "", fmt.Errorf("invalid length")
+	}
+
+	payload, checksum := decoded[:21], decoded[21:]
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	if !bytes.Equal(second[:4], checksum) {
+		return "", fmt.Errorf("invalid checksum")
+	}
+
+	switch payload[0] {
+	case 0x00, 0x05:
+		return "mainnet", nil
+	case 0x6f, 0xc4:
+		return "testnet", nil
+	}
+	return "", fmt.Errorf("unknown version byte %#x", payload[0])
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32 and bech32m differ by the constant their checksum ends with.
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+// checkSegwitAddress checks a BIP 173 or BIP 350 address with the given
+// human readable part.
+func checkSegwitAddress(address string, hrp string) error {
+	if len(address) > 90 {
+		return fmt.Errorf("invalid length")
+	}
+	if strings.ToLower(address) != address && strings.ToUpper(address) != address {
+		return fmt.Errorf("mixed case")
+	}
+	address = strings.ToLower(address)
+
+	separator := strings.LastIndexByte(address, '1')
+	if separator < 1 || address[:separator] != hrp || len(address)-separator-1 < 7 {
+		return fmt.Errorf("invalid format")
+	}
+
+	var data []int
+	for _, c := range address[separator+1:] {
+		value := strings.IndexRune(bech32Charset, c)
+		if value < 0 {
+			return fmt.Errorf("invalid character %q", c)
+		}
+		data = append(data, value)
+	}
+
+	var values []int
+	for _, c := range hrp {
+		values = append(values, int(c)>>5)
+	}
+	values = append(values, 0)
+	for _, c := range hrp {
+		values = append(values, int(c)&31)
+	}
+	checksum := bech32Polymod(append(values, data...))
+
+	version := data[0]
+	if version > 16 {
+		return fmt.Errorf("invalid witness version")
+	}
+	if version == 0 && checksum != bech32Const || version > 0 && checksum != bech32mConst {
+		return fmt.Errorf("invalid checksum")
+	}
+
+	program, ok := convertBits(data[1:len(data)-6], 5, 8)
+	if !ok || len(program) < 2 || len(program) > 40 {
+		return fmt.Errorf("invalid witness program")
+	}
+	if version == 0 && len(program) != 20 && len(program) != 32 {
+		return fmt.Errorf("invalid witness program")
+	}
+	return nil
+}
+
+func bech32Polymod(values []int) int {
+	generator := []int{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	checksum := 1
+	for _, value := range values {
+		top := checksum >> 25
+		checksum = (checksum&0x1ffffff)<<5 ^ value
+		for i, g := range generator {
+			if (top>>i)&1 == 1 {
+				checksum ^= g
+			}
+		}
+	}
+	return checksum
+}
+
+// convertBits regroups the bits of data from groups of from bits to groups
+// of to bits, refusing non zero padding.
+func convertBits(data []int, from, to uint) ([]byte, bool) {
+	var out []byte
+	acc, bits := 0, uint(0)
+	for _, value := range data {
+		acc = acc<<from | value
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&(1<<to-1)))
+		}
+	}
+	if bits >= from || acc<<(to-bits)&(1<<to-1) != 0 {
+		return nil, false
+	}
+	return out, true
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestBitcoinAddressNetwork(t *testing.T) {
+
+	for address, want := range map[string]string{
+		"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa":                             "mainnet",
+		"3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy":                             "mainnet",
+		"mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn":                             "testnet",
+		"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4":                     "mainnet",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0": "mainnet",
+		"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7": "testnet",
+	} {
+		network, err := bitcoinAddressNetwork(address)
+		if err != nil {
+			t.Errorf("%s: %v", address, err)
+		} else if network != want {
+			t.Errorf("%s: got %s want %s", address, network, want)
+		}
+	}
+
+	for _, address := range []string{
+		"",
+		"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNb", // checksum
+		"1A1zP1eP5QGefi2DMPTfTL5SLmv7Div0Na", // 0 is not base58
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5", // checksum
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh", // v0 with a bech32m checksum
+		"bc1Qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", // mixed case
+		"bc1",
+		"0x52908400098527886E0F7030069857D2E4169EE7",
+	} {
+		if _, err := bitcoinAddressNetwork(address); err == nil {
+			t.Errorf("%q accepted", address)
+		}
+	}
+
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultQueueTimeout is how long a queued request waits for a slot when
+// the limit doesn't say otherwise.
+const defaultQueueTimeout = 5 * time.Second
+
+// concurrencyLimit caps the requests of a route in flight to the upstream.
+// Requests over the cap wait in a queue of MaxQueue requests for at most
+// QueueTimeout, requests that don't fit in the queue are refused at once.
+type concurrencyLimit struct {
+	MaxInFlight  int      `json:"max_in_flight"`
+	MaxQueue     int      `json:"max_queue"`
+	QueueTimeout duration `json:"queue_timeout,omitempty"`
+}
+
+func (l *concurrencyLimit) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxInFlight < 1 || l.MaxQueue < 0 || l.QueueTimeout < 0 {
+		return fmt.Errorf("concurrency: max_in_flight must be at least 1, max_queue and queue_timeout must not be negative")
+	}
+	return nil
+}
+
+// concurrencyLimit returns the limit of the route, or the global one.
+func (c *proxyConfig) concurrencyLimit(r *route) *concurrencyLimit {
+	if r.Concurrency != nil {
+		return r.Concurrency
+	}
+	return c.Concurrency
+}
+
+// concurrencyStats are the counters of the limiter of a route.
+type concurrencyStats struct {
+	InFlight int64 `json:"in_flight"`
+	Queued   int64 `json:"queued"`
+	Rejected int64 `json:"rejected"`
+}
+
+type concurrencyLimiter struct {
+	limit    concurrencyLimit
+	slots    chan struct{}
+	queued   atomic.Int64
+	rejected atomic.Int64
+}
+
+func newConcurrencyLimiter(limit concurrencyLimit) *concurrencyLimiter {
+	return &concurrencyLimiter{limit: limit, slots: make(chan struct{}, limit.MaxInFlight)}
+}
+
+// acquire takes a slot, waiting in the queue when there is room in it. The
+// returned function gives the slot back.
+func (l *concurrencyLimiter) acquire(request *http.Request) (func(), bool) {
+	release := func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	if l.queued.Add(1) > int64(l.limit.MaxQueue) {
+		l.queued.Add(-1)
+		l.rejected.Add(1)
+		return nil, false
+	}
+	defer l.queued.Add(-1)
+
+	timeout := time.Duration(l.limit.QueueTimeout)
+	if timeout == 0 {
+		timeout = defaultQueueTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+	case <-request.Context().Done():
+	}
+	l.rejected.Add(1)
+	return nil, false
+}
+
+func (l *concurrencyLimiter) stats() concurrencyStats {
+	return concurrencyStats{
+		InFlight: int64(len(l.slots)),
+		Queued:   l.queued.Load(),
+		Rejected: l.rejected.Load(),
+	}
+}
+
+// concurrencyLimiters holds the limiter of every route, a route gets a new
+// limiter when its limit changes.
+type concurrencyLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*concurrencyLimiter
+}
+
+var limiters = &concurrencyLimiters{limiters: map[string]*concurrencyLimiter{}}
+
+func (ls *concurrencyLimiters) get(name string, limit concurrencyLimit) *concurrencyLimiter {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	l, ok := ls.limiters[name]
+	if !ok || l.limit != limit {
+		l = newConcurrencyLimiter(limit)
+		ls.limiters[name] = l
+	}
+	return l
+}
+
+// stats returns the counters of every route limiter by route name.
+func (ls *concurrencyLimiters) stats() map[string]concurrencyStats {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	stats := make(map[string]concurrencyStats, len(ls.limiters))
+	for name, l := range ls.limiters {
+		stats[name] = l.stats()
+	}
+	return stats
+}
+
+// acquireSlot waits for a free upstream slot of the route. It answers the
+// request with 503 and returns false when the route is saturated.
+func acquireSlot(writer http.ResponseWriter, request *http.Request, proxy *proxyConfig, r *route) (func(), bool) {
+	limit := proxy.concurrencyLimit(r)
+	if limit == nil {
+		return func() {}, true
+	}
+
+	release, ok := limiters.get(r.Name, *limit).acquire(request)
+	if !ok {
+		writer.Header().Set("Retry-After", "1")
+		httpError(writer, request, "Too many requests in flight", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return release, true
+}
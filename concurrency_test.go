@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+
+	l := newConcurrencyLimiter(concurrencyLimit{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: duration(time.Second)})
+	req := httptest.NewRequest("GET", "/", nil)
+
+	release, ok := l.acquire(req)
+	if !ok {
+		t.Fatalf("first request refused")
+	}
+
+	// the second request waits in the queue until the slot is released
+	acquired := make(chan bool)
+	go func() {
+		release, ok := l.acquire(req)
+		if ok {
+			release()
+		}
+		acquired <- ok
+	}()
+	for l.stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the queue is full, the third request is refused right away
+	start := time.Now()
+	if _, ok := l.acquire(req); ok {
+		t.Errorf("request accepted over the queue size")
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("request over the queue size was not refused right away")
+	}
+
+	release()
+	if !<-acquired {
+		t.Errorf("queued request refused after the slot was released")
+	}
+
+	stats := l.stats()
+	if stats.InFlight != 0 || stats.Queued != 0 || stats.Rejected != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+}
+
+func TestConcurrencyLimiterQueueTimeout(t *testing.T) {
+
+	l := newConcurrencyLimiter(concurrencyLimit{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: duration(10 * time.Millisecond)})
+	req := httptest.NewRequest("GET", "/", nil)
+
+	release, _ := l.acquire(req)
+	defer release()
+
+	if _, ok := l.acquire(req); ok {
+		t.Errorf("queued request accepted while the slot is taken")
+	}
+	if rejected := l.stats().Rejected; rejected != 1 {
+		t.Errorf("unexpected rejections: got %v want %v", rejected, 1)
+	}
+
+}
+
+func TestRedirectConcurrencyLimit(t *testing.T) {
+
+	// Create a test server that blocks until it is released
+	started := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activeConfig.Store(&proxyConfig{
+		MaxBodyBytes: defaultMaxBodyBytes,
+		Routes: []*route{{
+			Name:        "slow",
+			Path:        "/slow",
+			Concurrency: &concurrencyLimit{MaxInFlight: 1},
+		}},
+	})
+	defer activeConfig.Store(nil)
+
+	// limiters outlive the test, so the rejections it adds are checked
+	before := limiters.stats()["slow"]
+
+	done := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(redirect).ServeHTTP(rr, httptest.NewRequest("GET", "/slow", nil))
+		done <- rr.Code
+	}()
+	<-started
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(redirect).ServeHTTP(rr, httptest.NewRequest("GET", "/slow", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	close(unblock)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+
+	if stats := limiters.stats()["slow"]; stats.Rejected-before.Rejected != 1 || stats.InFlight != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+}
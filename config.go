@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverConfig holds the listener settings, each one can be set through
+// its environment variable and overridden by the matching flag.
+type serverConfig struct {
+	// Listen is a host:port address, or unix:/path/to/socket.
+	Listen string
+	// AdminListen is the address of the admin listener, empty disables it.
+	AdminListen string
+	// ConfigFile is the JSON file holding the route configuration.
+	ConfigFile string
+	// ConfigWatchInterval is how often the config file is checked for
+	// changes, zero only reloads on SIGHUP.
+	ConfigWatchInterval time.Duration
+
+	// LogLevel is debug, info, warn or error.
+	LogLevel string
+	// LogFormat is json or text.
+	LogFormat string
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+}
+
+func parseServerConfig(args []string) (serverConfig, error) {
+	config := serverConfig{
+		Listen:              envString("LISTEN_ADDR", "0.0.0.0:8080"),
+		AdminListen:         envString("ADMIN_LISTEN_ADDR", "127.0.0.1:9090"),
+		ConfigFile:          envString("CONFIG_FILE", "config.json"),
+		ConfigWatchInterval: 5 * time.Second,
+		LogLevel:            envString("LOG_LEVEL", "info"),
+		LogFormat:           envString("LOG_FORMAT", "json"),
+		ReadHeaderTimeout:   5 * time.Second,
+		ReadTimeout:         30 * time.Second,
+		// must leave room for the 60 seconds the upstream is given to answer
+		WriteTimeout: 90 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+
+	var err error
+	if config.ConfigWatchInterval, err = envDuration("CONFIG_WATCH_INTERVAL", config.ConfigWatchInterval); err != nil {
+		return config, err
+	}
+	if config.ReadHeaderTimeout, err = envDuration("READ_HEADER_TIMEOUT", config.ReadHeaderTimeout); err != nil {
+		return config, err
+	}
+	if config.ReadTimeout, err = envDuration("READ_TIMEOUT", config.ReadTimeout); err != nil {
+		return config, err
+	}
+	if config.WriteTimeout, err = envDuration("WRITE_TIMEOUT", config.WriteTimeout); err != nil {
+		return config, err
+	}
+	if config.IdleTimeout, err = envDuration("IDLE_TIMEOUT", config.IdleTimeout); err != nil {
+		return config, err
+	}
+
+	flags := flag.NewFlagSet("wallet-bc-redirect", flag.ContinueOnError)
+	flags.StringVar(&config.Listen, "listen", config.Listen, "listen address, host:port or unix:/path/to/socket")
+	flags.StringVar(&config.AdminListen, "admin-listen", config.AdminListen, "admin listen address, empty to disable")
+	flags.StringVar(&config.ConfigFile, "config", config.ConfigFile, "route configuration file")
+	flags.DurationVar(&config.ConfigWatchInterval, "config-watch-interval", config.ConfigWatchInterval, "how often the config file is checked for changes, 0 to only reload on SIGHUP")
+	flags.StringVar(&config.LogLevel, "log-level", config.LogLevel, "minimum log level: debug, info, warn or error")
+	flags.StringVar(&config.LogFormat, "log-format", config.LogFormat, "log format: json or text")
+	flags.DurationVar(&config.ReadHeaderTimeout, "read-header-timeout", config.ReadHeaderTimeout, "time allowed to read request headers")
+	flags.DurationVar(&config.ReadTimeout, "read-timeout", config.ReadTimeout, "time allowed to read a whole request")
+	flags.DurationVar(&config.WriteTimeout, "write-timeout", config.WriteTimeout, "time allowed to write a response")
+	flags.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "time keep-alive connections are kept idle")
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+
+	if config.Listen == "" {
+		return config, fmt.Errorf("listen address must not be empty")
+	}
+	if config.Listen == config.AdminListen {
+		return config, fmt.Errorf("admin listen address must differ from the listen address")
+	}
+	if config.ConfigWatchInterval < 0 {
+		return config, fmt.Errorf("config watch interval must not be negative")
+	}
+	for name, d := range map[string]time.Duration{
+		"read header timeout": config.ReadHeaderTimeout,
+		"read timeout":        config.ReadTimeout,
+		"write timeout":       config.WriteTimeout,
+		"idle timeout":        config.IdleTimeout,
+	} {
+		if d <= 0 {
+			return config, fmt.Errorf("%s must be positive", name)
+		}
+	}
+
+	return config, nil
+}
+
+// listen opens a TCP listener for host:port addresses and a Unix socket
+// listener for unix:/path addresses.
+func listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		path := strings.TrimPrefix(address, "unix:")
+		// remove a socket left behind by a previous run
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", address)
+}
+
+func envString(name string, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+func envInt(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return n, nil
+}
+
+func envDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return d, nil
+}
+
+// duration is a time.Duration read from and written to JSON as a string
+// such as "5s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\"")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
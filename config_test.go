@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseServerConfigDefaults(t *testing.T) {
+
+	config, err := parseServerConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Listen != "0.0.0.0:8080" || config.AdminListen != "127.0.0.1:9090" {
+		t.Errorf("unexpected default addresses: %q %q", config.Listen, config.AdminListen)
+	}
+
+	// every timeout has a default so slow clients can't hold connections
+	if config.ReadHeaderTimeout <= 0 || config.ReadTimeout <= 0 || config.WriteTimeout <= 0 || config.IdleTimeout <= 0 {
+		t.Errorf("unexpected default timeouts: %+v", config)
+	}
+
+}
+
+func TestParseServerConfigEnvAndFlags(t *testing.T) {
+
+	t.Setenv("LISTEN_ADDR", "127.0.0.1:8081")
+	t.Setenv("ADMIN_LISTEN_ADDR", "")
+	t.Setenv("READ_TIMEOUT", "10s")
+	t.Setenv("WRITE_TIMEOUT", "20s")
+
+	config, err := parseServerConfig([]string{"-listen", "unix:/tmp/redirect.sock", "-write-timeout", "30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flags take precedence over the environment
+	if config.Listen != "unix:/tmp/redirect.sock" {
+		t.Errorf("unexpected listen address: got %q want %q", config.Listen, "unix:/tmp/redirect.sock")
+	}
+	if config.WriteTimeout != 30*time.Second {
+		t.Errorf("unexpected write timeout: got %v want %v", config.WriteTimeout, 30*time.Second)
+	}
+
+	if config.AdminListen != "" {
+		t.Errorf("admin listener not disabled: %q", config.AdminListen)
+	}
+	if config.ReadTimeout != 10*time.Second {
+		t.Errorf("unexpected read timeout: got %v want %v", config.ReadTimeout, 10*time.Second)
+	}
+
+}
+
+func TestParseServerConfigInvalid(t *testing.T) {
+
+	for name, args := range map[string][]string{
+		"empty listen":     {"-listen", ""},
+		"same addresses":   {"-listen", ":8080", "-admin-listen", ":8080"},
+		"zero timeout":     {"-read-header-timeout", "0s"},
+		"negative timeout": {"-idle-timeout", "-1s"},
+		"unknown flag":     {"-port", "8080"},
+	} {
+		if _, err := parseServerConfig(args); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	t.Setenv("READ_TIMEOUT", "soon")
+	if _, err := parseServerConfig(nil); err == nil {
+		t.Errorf("invalid READ_TIMEOUT accepted")
+	}
+
+}
+
+func TestListenUnixSocket(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "redirect.sock")
+	listener, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer(serverConfig{ReadHeaderTimeout: time.Second}, http.HandlerFunc(healthz))
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	if listener.Addr().Network() != "unix" || listener.Addr().String() != path {
+		t.Errorf("unexpected listener address: %v", listener.Addr())
+	}
+
+}
+
+func TestDurationJSON(t *testing.T) {
+
+	var d duration
+	if err := d.UnmarshalJSON([]byte(`"1m30s"`)); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(d) != 90*time.Second {
+		t.Errorf("unexpected duration: got %v want %v", time.Duration(d), 90*time.Second)
+	}
+
+	data, err := d.MarshalJSON()
+	if err != nil || string(data) != `"1m30s"` {
+		t.Errorf("unexpected JSON: %s %v", data, err)
+	}
+
+	for _, invalid := range []string{`90`, `"soon"`} {
+		if err := d.UnmarshalJSON([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+
+}
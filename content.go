@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// contentPolicy decides which media types a route accepts in POST and PUT
+// bodies and which ones it answers with. Media types may end with a
+// wildcard subtype, such as text/*.
+type contentPolicy struct {
+	// Types lists the media types bodies may be sent as. When empty, the
+	// Content-Type of bodies isn't checked.
+	Types []string `json:"types,omitempty"`
+	// Charsets lists the charsets bodies may be encoded with: utf-8,
+	// us-ascii or iso-8859-1. Defaults to utf-8.
+	Charsets []string `json:"charsets,omitempty"`
+	// Produces lists the media types of the responses, without wildcards,
+	// checked against the Accept header of the request. Empty accepts any
+	// Accept header.
+	Produces []string `json:"produces,omitempty"`
+}
+
+// charsetAliases maps the charset names bodies can be checked for to
+// their canonical name.
+var charsetAliases = map[string]string{
+	"utf-8":      "utf-8",
+	"utf8":       "utf-8",
+	"us-ascii":   "us-ascii",
+	"ascii":      "us-ascii",
+	"iso-8859-1": "iso-8859-1",
+	"latin1":     "iso-8859-1",
+}
+
+func (p *contentPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	for i, t := range p.Types {
+		mediaType, _, err := mime.ParseMediaType(t)
+		if err != nil || !strings.Contains(mediaType, "/") || strings.HasPrefix(mediaType, "*/") {
+			return fmt.Errorf("content: invalid media type %q", t)
+		}
+		p.Types[i] = mediaType
+	}
+	for i, t := range p.Produces {
+		mediaType, _, err := mime.ParseMediaType(t)
+		if err != nil || !strings.Contains(mediaType, "/") || strings.Contains(mediaType, "*") {
+			return fmt.Errorf("content: invalid produced media type %q", t)
+		}
+		p.Produces[i] = mediaType
+	}
+	for i, charset := range p.Charsets {
+		canonical, ok := charsetAliases[strings.ToLower(charset)]
+		if !ok {
+			return fmt.Errorf("content: unsupported charset %q", charset)
+		}
+		p.Charsets[i] = canonical
+	}
+	if len(p.Charsets) == 0 {
+		p.Charsets = []string{"utf-8"}
+	}
+	return nil
+}
+
+// contentPolicy returns the content policy of the route, or the global
+// one, nil when neither is set.
+func (c *proxyConfig) contentPolicy(r *route) *contentPolicy {
+	if r.Content != nil {
+		return r.Content
+	}
+	return c.Content
+}
+
+// mediaTypeMatches reports whether mediaType is matched by pattern, where
+// */* and type/* are wildcards.
+func mediaTypeMatches(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(pattern, "/*")
+	return ok && strings.HasPrefix(mediaType, prefix+"/")
+}
+
+// checkContentType returns the media type and the charset of a body sent
+// with the contentType header, or an error when the policy refuses them.
+// The charset is empty when it can't be known, and both are when the policy
+// lists no types.
+func (p *contentPolicy) checkContentType(contentType string) (string, string, error) {
+	if len(p.Types) == 0 {
+		return "", "", nil
+	}
+	if contentType == "" {
+		return "", "", errors.New("missing Content-Type")
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid Content-Type: %v", err)
+	}
+
+	accepted := false
+	for _, t := range p.Types {
+		if mediaTypeMatches(t, mediaType) {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		return "", "", fmt.Errorf("unsupported content type %s, expected %s", mediaType, strings.Join(p.Types, ", "))
+	}
+
+	charset, ok := params["charset"]
+	if !ok {
+		// JSON is always UTF-8 and so is text by default here, other
+		// media types are only checked when they declare a charset
+		if jsonMediaType(mediaType) || strings.HasPrefix(mediaType, "text/") {
+			return mediaType, "utf-8", nil
+		}
+		return mediaType, "", nil
+	}
+	canonical := charsetAliases[strings.ToLower(charset)]
+	if !contains(p.Charsets, canonical) {
+		return "", "", fmt.Errorf("unsupported charset %s, expected %s", charset, strings.Join(p.Charsets, ", "))
+	}
+	return mediaType, canonical, nil
+}
+
+// checkBodyContent returns an error when body isn't encoded with charset or
+// doesn't parse as mediaType. Media types the proxy can't parse are only
+// checked for their charset.
+func checkBodyContent(body []byte, mediaType, charset string) error {
+	switch charset {
+	case "utf-8":
+		if !utf8.Valid(body) {
+			return errors.New("body is not valid UTF-8")
+		}
+	case "us-ascii":
+		for _, c := range body {
+			if c >= 0x80 {
+				return errors.New("body is not valid US-ASCII")
+			}
+		}
+	}
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		if !json.Valid(body) {
+			return errors.New("body is not valid JSON")
+		}
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		decoder := xml.NewDecoder(bytes.NewReader(body))
+		// the charset was checked above, the declaration may name any
+		decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) { return input, nil }
+		for {
+			_, err := decoder.Token()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("body is not valid XML: %v", err)
+			}
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		if _, err := url.ParseQuery(string(body)); err != nil {
+			return fmt.Errorf("body is not a valid form: %v", err)
+		}
+	}
+	return nil
+}
+
+// acceptable reports whether a client sending the accept header takes one
+// of the media types the route produces. Ranges with a zero quality are
+// refusals, and an empty header accepts anything.
+func (p *contentPolicy) acceptable(accept string) bool {
+	if len(p.Produces) == 0 || strings.TrimSpace(accept) == "" {
+		return true
+	}
+
+	type mediaRange struct {
+		pattern string
+		quality float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType, quality})
+	}
+	// the most specific range decides, so text/html;q=0 refuses HTML even
+	// when */* is accepted
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return strings.Count(ranges[i].pattern, "*") < strings.Count(ranges[j].pattern, "*")
+	})
+
+	for _, produced := range p.Produces {
+		for _, r := range ranges {
+			if mediaTypeMatches(r.pattern, produced) {
+				if r.quality > 0 {
+					return true
+				}
+				break
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContentPolicyCheckContentType(t *testing.T) {
+
+	p := &contentPolicy{Types: []string{"application/json", "text/*"}, Charsets: []string{"utf-8", "ascii"}}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		contentType string
+		mediaType   string
+		charset     string
+		ok          bool
+	}{
+		{"application/json", "application/json", "utf-8", true},
+		{"Application/JSON; charset=UTF-8", "application/json", "utf-8", true},
+		{"text/plain; charset=us-ascii", "text/plain", "us-ascii", true},
+		{"text/csv", "text/csv", "utf-8", true},
+		{"", "", "", false},
+		{"application/xml", "", "", false},
+		{"application/json; charset=iso-8859-1", "", "", false},
+		{"application/json; charset=utf-16", "", "", false},
+		{"application/json;;", "", "", false},
+	} {
+		mediaType, charset, err := p.checkContentType(tc.contentType)
+		if (err == nil) != tc.ok || mediaType != tc.mediaType || charset != tc.charset {
+			t.Errorf("%q: got %q, %q, %v", tc.contentType, mediaType, charset, err)
+		}
+	}
+
+	// only JSON and text are taken as UTF-8 without a charset
+	binary := &contentPolicy{Types: []string{"application/*"}}
+	if err := binary.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if mediaType, charset, err := binary.checkContentType("application/octet-stream"); err != nil || mediaType != "application/octet-stream" || charset != "" {
+		t.Errorf("application/octet-stream: got %q, %q, %v", mediaType, charset, err)
+	}
+
+	// a policy listing no types doesn't check the Content-Type
+	produces := &contentPolicy{Produces: []string{"application/json"}}
+	if err := produces.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, contentType := range []string{"", "application/octet-stream", "application/json; charset=utf-16"} {
+		if mediaType, charset, err := produces.checkContentType(contentType); err != nil || mediaType != "" || charset != "" {
+			t.Errorf("%q: got %q, %q, %v", contentType, mediaType, charset, err)
+		}
+	}
+
+}
+
+func TestCheckBodyContent(t *testing.T) {
+
+	for _, tc := range []struct {
+		body      string
+		mediaType string
+		charset   string
+		ok        bool
+	}{
+		{`{"invoice":"123456"}`, "application/json", "utf-8", true},
+		{`{"invoice":`, "application/json", "utf-8", false},
+		{`{"a":1} {"b":2}`, "application/problem+json", "utf-8", false},
+		{"{\"name\":\"\xff\"}", "application/json", "utf-8", false},
+		{`<invoice id="1"/>`, "application/xml", "utf-8", true},
+		{`<invoice>`, "text/xml", "utf-8", false},
+		{"status=pending&wallet_id=123", "application/x-www-form-urlencoded", "utf-8", true},
+		{"status=%zz", "application/x-www-form-urlencoded", "utf-8", false},
+		{"café", "text/plain", "us-ascii", false},
+		{"caf\xe9", "text/plain", "iso-8859-1", true},
+		{"\x00\x01", "application/octet-stream", "iso-8859-1", true},
+	} {
+		if err := checkBodyContent([]byte(tc.body), tc.mediaType, tc.charset); (err == nil) != tc.ok {
+			t.Errorf("%q as %s: got %v", tc.body, tc.mediaType, err)
+		}
+	}
+
+}
+
+func TestContentPolicyAcceptable(t *testing.T) {
+
+	p := &contentPolicy{Produces: []string{"application/json"}}
+	for accept, want := range map[string]bool{
+		"":                                  true,
+		"application/json":                  true,
+		"application/*":                     true,
+		"*/*":                               true,
+		"text/html, application/json;q=0.5": true,
+		"text/html":                         false,
+		"application/json;q=0":              false,
+		"*/*, application/json;q=0":         false,
+		"text/html;q=0.9, */*;q=0.1":        true,
+		"application/json;q=invalid":        false,
+	} {
+		if got := p.acceptable(accept); got != want {
+			t.Errorf("%q: got %v want %v", accept, got, want)
+		}
+	}
+
+}
+
+func TestContentPolicyValidate(t *testing.T) {
+
+	for _, p := range []*contentPolicy{
+		{Types: []string{"json"}},
+		{Types: []string{"*/*"}},
+		{Charsets: []string{"utf-16"}},
+		{Produces: []string{"application/*"}},
+	} {
+		if err := p.validate(); err == nil {
+			t.Errorf("%+v: invalid policy accepted", p)
+		}
+	}
+
+}
+
+func TestRedirectContentPolicy(t *testing.T) {
+
+	forwarded := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+	}))
+	defer ts.Close()
+
+	t.Setenv("REDIRECT_URL", ts.URL)
+	activeConfig.Store(mustProxyConfig(t, `{
+		"routes": [{
+			"name": "invoices",
+			"path": "/invoices",
+			"content": {"types": ["application/json"], "produces": ["application/json"]}
+		}, {
+			"name": "uploads",
+			"path": "/uploads",
+			"content": {"produces": ["application/json"]}
+		}]
+	}`))
+	defer activeConfig.Store(nil)
+
+	for _, tc := range []struct {
+		method      string
+		contentType string
+		accept      string
+		body        string
+		status      int
+	}{
+		{"POST", "application/json; charset=utf-8", "application/json", `{"invoice":"123456"}`, http.StatusOK},
+		{"PUT", "application/json", "", `{"invoice":"123456"}`, http.StatusOK},
+		{"POST", "text/plain", "", `{"invoice":"123456"}`, http.StatusUnsupportedMediaType},
+		{"POST", "", "", `{"invoice":"123456"}`, http.StatusUnsupportedMediaType},
+		{"POST", "application/json; charset=latin1", "", `{"invoice":"123456"}`, http.StatusUnsupportedMediaType},
+		{"POST", "application/json", "", `{"invoice":`, http.StatusBadRequest},
+		{"POST", "application/json", "text/html", `{"invoice":"123456"}`, http.StatusNotAcceptable},
+		{"GET", "", "text/html", "", http.StatusNotAcceptable},
+		{"GET", "", "application/json", "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, "/invoices", strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		rr := httptest.NewRecorder()
+		newMux().ServeHTTP(rr, req)
+		if rr.Code != tc.status {
+			t.Errorf("%s %q accepting %q: got status %v want %v", tc.method, tc.contentType, tc.accept, rr.Code, tc.status)
+		}
+	}
+	if forwarded != 3 {
+		t.Errorf("got %d requests forwarded want 3", forwarded)
+	}
+
+	// a policy only setting produces doesn't check bodies
+	for _, contentType := range []string{"", "application/octet-stream"} {
+		req := httptest.NewRequest("POST", "/uploads", strings.NewReader("\xff\x00\x01"))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		newMux().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("POST %q to /uploads: got status %v want %v", contentType, rr.Code, http.StatusOK)
+		}
+	}
+
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// corsPolicy lets browser pages of other origins call a route.
+type corsPolicy struct {
+	// Origins lists the allowed origins, such as https://wallet.example.com.
+	// A * in the host matches any host name characters, so
+	// https://*.example.com allows the subdomains, and * alone allows every
+	// origin.
+	Origins []string `json:"origins"`
+	// Methods lists the allowed methods, GET, POST and PUT by default.
+	Methods []string `json:"methods,omitempty"`
+	// Headers lists the request headers pages may send, * wildcards
+	// allowed.
+	Headers []string `json:"headers,omitempty"`
+	// ExposeHeaders lists the response headers pages may read.
+	ExposeHeaders []string `json:"expose_headers,omitempty"`
+	// Credentials lets pages send cookies and authorization headers.
+	Credentials bool `json:"credentials,omitempty"`
+	// MaxAge is how long, in seconds, browsers may cache a preflight
+	// response. Not sent when zero.
+	MaxAge int `json:"max_age,omitempty"`
+
+	origins []*regexp.Regexp
+	headers []*regexp.Regexp
+}
+
+func (p *corsPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	if len(p.Origins) == 0 {
+		return fmt.Errorf("cors: origins is required")
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("cors: max_age must not be negative")
+	}
+
+	p.origins = nil
+	for _, origin := range p.Origins {
+		if origin == "*" {
+			if p.Credentials {
+				return fmt.Errorf("cors: credentials can't be allowed to every origin")
+			}
+			p.origins = append(p.origins, regexp.MustCompile(`^.*$`))
+			continue
+		}
+		scheme, host, ok := strings.Cut(origin, "://")
+		if !ok || scheme == "" || host == "" || strings.ContainsAny(host, "/?#@") {
+			return fmt.Errorf("cors: invalid origin %q", origin)
+		}
+		parts := strings.Split(strings.ToLower(origin), "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		// a wildcard can't reach into the port or past the host
+		p.origins = append(p.origins, regexp.MustCompile("^"+strings.Join(parts, "[a-z0-9.-]+")+"$"))
+	}
+
+	if len(p.Methods) == 0 {
+		p.Methods = []string{http.MethodGet, http.MethodPost, http.MethodPut}
+	}
+	for i, method := range p.Methods {
+		if !validHeaderName(method) {
+			return fmt.Errorf("cors: invalid method %q", method)
+		}
+		p.Methods[i] = strings.ToUpper(method)
+	}
+
+	var err error
+	if p.headers, err = namePatterns(p.Headers); err != nil {
+		return fmt.Errorf("cors: %v", err)
+	}
+	for _, name := range p.ExposeHeaders {
+		if !validHeaderName(name) {
+			return fmt.Errorf("cors: invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// corsPolicy returns the CORS policy of the route, or the global one, nil
+// when neither is set.
+func (c *proxyConfig) corsPolicy(r *route) *corsPolicy {
+	if r.CORS != nil {
+		return r.CORS
+	}
+	return c.CORS
+}
+
+func (p *corsPolicy) allowedOrigin(origin string) bool {
+	return matchesAny(p.origins, strings.ToLower(origin))
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin of an allowed origin.
+func (p *corsPolicy) allowOrigin(origin string) string {
+	if contains(p.Origins, "*") {
+		return "*"
+	}
+	return origin
+}
+
+// handleCORS answers the preflight requests of the routes with a CORS
+// policy and adds the CORS headers to the responses of allowed origins.
+// Responses of those routes vary by Origin whether or not it is allowed,
+// or even sent.
+func handleCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get("Origin")
+		proxy := proxyConfigFrom(request.Context())
+
+		requestedMethod := request.Header.Get("Access-Control-Request-Method")
+		if request.Method == http.MethodOptions && origin != "" && requestedMethod != "" {
+			// the route of a preflight is the one of the request it announces
+			announced := *request
+			announced.Method = requestedMethod
+			policy := proxy.corsPolicy(proxy.match(&announced))
+			if policy == nil {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			preflight(writer, request, policy, origin, requestedMethod)
+			return
+		}
+
+		// responses without an Origin vary by it too, so caches don't
+		// serve them to cross-origin requests
+		policy := proxy.corsPolicy(proxy.match(request))
+		if policy == nil {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		next.ServeHTTP(&corsWriter{ResponseWriter: writer, policy: policy, origin: origin}, request)
+	})
+}
+
+// preflight answers a preflight request from the policy alone, the
+// upstream never sees it.
+func preflight(writer http.ResponseWriter, request *http.Request, policy *corsPolicy, origin string, method string) {
+	header := writer.Header()
+	header.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+
+	if !policy.allowedOrigin(origin) {
+		httpError(writer, request, "CORS origin not allowed", http.StatusForbidden)
+		return
+	}
+	if !contains(policy.Methods, method) {
+		httpError(writer, request, "CORS method not allowed", http.StatusForbidden)
+		return
+	}
+	var requested []string
+	for _, name := range strings.Split(request.Header.Get("Access-Control-Request-Headers"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !matchesAny(policy.headers, name) {
+			httpError(writer, request, "CORS header not allowed: "+name, http.StatusForbidden)
+			return
+		}
+		requested = append(requested, name)
+	}
+
+	header.Set("Access-Control-Allow-Origin", policy.allowOrigin(origin))
+	header.Set("Access-Control-Allow-Methods", strings.Join(policy.Methods, ", "))
+	if len(requested) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if policy.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if policy.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// corsWriter replaces the CORS headers of a response, the upstream's
+// included, with those of the policy when the response is written.
+type corsWriter struct {
+	http.ResponseWriter
+	policy      *corsPolicy
+	origin      string
+	wroteHeader bool
+}
+
+func (w *corsWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		header := w.Header()
+		for name := range header {
+			if strings.HasPrefix(name, "Access-Control-") {
+				header.Del(name)
+			}
+		}
+		header.Add("Vary", "Origin")
+		if w.origin != "" && w.policy.allowedOrigin(w.origin) {
+			header.Set("Access-Control-Allow-Origin", w.policy.allowOrigin(w.origin))
+			if w.policy.Credentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(w.policy.ExposeHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(w.policy.ExposeHeaders, ", "))
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *corsWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
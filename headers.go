@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// defaultMaxHeaderValueLength bounds header values when the policy doesn't
+// say otherwise.
+const defaultMaxHeaderValueLength = 8192
+
+// headerPolicy decides which request headers are accepted and how they
+// are forwarded upstream. Names are matched without regard to case and may
+// contain * wildcards, such as X-Wallet-*.
+type headerPolicy struct {
+	// Allow lists the only headers accepted, empty accepts every header
+	// that isn't denied.
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists headers that are never accepted.
+	Deny []string `json:"deny,omitempty"`
+	// Disallowed is what happens to a request carrying a header that isn't
+	// accepted: reject answers 400, strip drops the header. Defaults to
+	// reject.
+	Disallowed string `json:"disallowed,omitempty"`
+
+	// MaxValueLength bounds the length of every value, 8192 by default.
+	MaxValueLength int `json:"max_value_length,omitempty"`
+	// Charset restricts values to printable ASCII when set to ascii.
+	// Control characters, CR and LF included, are always refused.
+	Charset string `json:"charset,omitempty"`
+	// Values holds a regular expression every value of the header must
+	// match, by header name.
+	Values map[string]string `json:"values,omitempty"`
+
+	// Add sets headers the request doesn't carry.
+	Add map[string]string `json:"add,omitempty"`
+	// Set sets headers, replacing the values sent by the client.
+	Set map[string]string `json:"set,omitempty"`
+	// Remove drops headers before the request is forwarded.
+	Remove []string `json:"remove,omitempty"`
+	// Rename forwards headers under another name, by current name.
+	Rename map[string]string `json:"rename,omitempty"`
+
+	// Response transforms the headers of the upstream response.
+	Response *responseHeaders `json:"response,omitempty"`
+
+	allow  []*regexp.Regexp
+	deny   []*regexp.Regexp
+	remove []*regexp.Regexp
+	values map[string]*regexp.Regexp
+}
+
+// defaultHeaderPolicy accepts every well formed header.
+var defaultHeaderPolicy = mustHeaderPolicy(&headerPolicy{})
+
+func mustHeaderPolicy(p *headerPolicy) *headerPolicy {
+	if err := p.validate(); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// validate checks the policy and compiles its patterns.
+func (p *headerPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.Disallowed != "" && p.Disallowed != "reject" && p.Disallowed != "strip" {
+		return fmt.Errorf("headers: disallowed must be reject or strip")
+	}
+	if p.Charset != "" && p.Charset != "ascii" {
+		return fmt.Errorf("headers: charset must be ascii")
+	}
+	if p.MaxValueLength < 0 {
+		return fmt.Errorf("headers: max_value_length must not be negative")
+	}
+
+	var err error
+	if p.allow, err = namePatterns(p.Allow); err != nil {
+		return err
+	}
+	if p.deny, err = namePatterns(p.Deny); err != nil {
+		return err
+	}
+	if p.remove, err = namePatterns(p.Remove); err != nil {
+		return err
+	}
+
+	p.values = map[string]*regexp.Regexp{}
+	for name, pattern := range p.Values {
+		if !validHeaderName(name) {
+			return fmt.Errorf("headers: invalid header name %q", name)
+		}
+		compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("headers: value pattern of %s: %v", name, err)
+		}
+		p.values[http.CanonicalHeaderKey(name)] = compiled
+	}
+
+	for _, headers := range []map[string]string{p.Add, p.Set} {
+		for name, value := range headers {
+			if !validHeaderName(name) {
+				return fmt.Errorf("headers: invalid header name %q", name)
+			}
+			if err := p.checkValue(value); err != nil {
+				return fmt.Errorf("headers: value of %s: %v", name, err)
+			}
+		}
+	}
+	if err := validateRenames(p.Rename); err != nil {
+		return err
+	}
+	return p.Response.validate()
+}
+
+// validateRenames checks the names of rename rules, which can't be
+// wildcards.
+func validateRenames(renames map[string]string) error {
+	for from, to := range renames {
+		for _, name := range []string{from, to} {
+			if !validHeaderName(name) || strings.Contains(name, "*") {
+				return fmt.Errorf("headers: invalid header name %q in rename", name)
+			}
+		}
+	}
+	return nil
+}
+
+// namePatterns compiles header name patterns where * matches any sequence
+// of characters.
+func namePatterns(names []string) ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(names))
+	for _, name := range names {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("headers: invalid header name %q", name)
+		}
+		parts := strings.Split(name, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		patterns = append(patterns, regexp.MustCompile("(?i)^"+strings.Join(parts, ".*")+"$"))
+	}
+	return patterns, nil
+}
+
+func matchesAny(patterns []*regexp.Regexp, name string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerPolicy returns the header policy of the route, or the global one.
+func (c *proxyConfig) headerPolicy(r *route) *headerPolicy {
+	if r.Headers != nil {
+		return r.Headers
+	}
+	if c.Headers != nil {
+		return c.Headers
+	}
+	return defaultHeaderPolicy
+}
+
+// accepted reports whether the policy lets the header through.
+func (p *headerPolicy) accepted(name string) bool {
+	if len(p.allow) > 0 && !matchesAny(p.allow, name) {
+		return false
+	}
+	return !matchesAny(p.deny, name)
+}
+
+// check returns the first header of the request the policy refuses.
+// Headers that aren't accepted are only refused when Disallowed is reject.
+func (p *headerPolicy) check(header http.Header) error {
+	for name, values := range header {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name: %q", name)
+		}
+		if !p.accepted(name) {
+			if p.Disallowed == "strip" {
+				continue
+			}
+			return fmt.Errorf("header not allowed: %s", name)
+		}
+		for _, value := range values {
+			if err := p.checkValue(value); err != nil {
+				return fmt.Errorf("invalid value of header %s: %v", name, err)
+			}
+			if pattern, ok := p.values[http.CanonicalHeaderKey(name)]; ok && !pattern.MatchString(value) {
+				return fmt.Errorf("invalid value of header %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkValue refuses values over the length limit and values carrying
+// characters outside the charset of the policy.
+func (p *headerPolicy) checkValue(value string) error {
+	limit := p.MaxValueLength
+	if limit == 0 {
+		limit = defaultMaxHeaderValueLength
+	}
+	if len(value) > limit {
+		return fmt.Errorf("longer than %d bytes", limit)
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\r' || c == '\n':
+			return fmt.Errorf("line break")
+		case c < ' ' && c != '\t' || c == 0x7f:
+			return fmt.Errorf("control character")
+		case c > '~' && p.Charset == "ascii":
+			return fmt.Errorf("non ASCII character")
+		}
+	}
+	return nil
+}
+
+// apply returns the headers to forward upstream: the accepted headers of
+// the request without the removed ones, renamed, with the added and set
+// headers.
+// {name} placeholders of added and set values are replaced with vars.
+func (p *headerPolicy) apply(header http.Header, vars map[string]string) http.Header {
+	forwarded := make(http.Header, len(header)+len(p.Add)+len(p.Set))
+	for name, values := range header {
+		if !p.accepted(name) || matchesAny(p.remove, name) {
+			continue
+		}
+		forwarded[name] = append([]string(nil), values...)
+	}
+	renameHeaders(forwarded, p.Rename)
+	for name, value := range p.Add {
+		if forwarded.Get(name) == "" {
+			forwarded.Set(name, expandVariables(value, vars))
+		}
+	}
+	for name, value := range p.Set {
+		forwarded.Set(name, expandVariables(value, vars))
+	}
+	return forwarded
+}
+
+// renameHeaders moves the values of every header named by renames to its
+// new name, replacing the values the new name had.
+func renameHeaders(header http.Header, renames map[string]string) {
+	for from, to := range renames {
+		values := header.Values(from)
+		if len(values) == 0 {
+			continue
+		}
+		header.Del(from)
+		header[http.CanonicalHeaderKey(to)] = values
+	}
+}
+
+// responseHeaders transforms the headers of upstream responses before they
+// reach the client, such as to hide Server or X-Powered-By.
+type responseHeaders struct {
+	// Remove drops headers, * wildcards allowed.
+	Remove []string `json:"remove,omitempty"`
+	// Rename sends headers under another name, by current name.
+	Rename map[string]string `json:"rename,omitempty"`
+	// Add sets headers the response doesn't carry.
+	Add map[string]string `json:"add,omitempty"`
+	// Set sets headers, replacing the values of the upstream.
+	Set map[string]string `json:"set,omitempty"`
+
+	remove []*regexp.Regexp
+}
+
+func (r *responseHeaders) validate() error {
+	if r == nil {
+		return nil
+	}
+	var err error
+	if r.remove, err = namePatterns(r.Remove); err != nil {
+		return fmt.Errorf("response %v", err)
+	}
+	if err := validateRenames(r.Rename); err != nil {
+		return fmt.Errorf("response %v", err)
+	}
+	for _, headers := range []map[string]string{r.Add, r.Set} {
+		for name, value := range headers {
+			if !validHeaderName(name) {
+				return fmt.Errorf("response headers: invalid header name %q", name)
+			}
+			if err := (&headerPolicy{}).checkValue(value); err != nil {
+				return fmt.Errorf("response headers: value of %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// apply returns the headers to send to the client: the headers of the
+// upstream response without the removed ones, renamed, with the added and
+// set headers. {name} placeholders of values are replaced with vars.
+func (r *responseHeaders) apply(header http.Header, vars map[string]string) http.Header {
+	if r == nil {
+		return header
+	}
+	transformed := make(http.Header, len(header)+len(r.Add)+len(r.Set))
+	for name, values := range header {
+		if matchesAny(r.remove, name) {
+			continue
+		}
+		transformed[name] = append([]string(nil), values...)
+	}
+	renameHeaders(transformed, r.Rename)
+	for name, value := range r.Add {
+		if transformed.Get(name) == "" {
+			transformed.Set(name, expandVariables(value, vars))
+		}
+	}
+	for name, value := range r.Set {
+		transformed.Set(name, expandVariables(value, vars))
+	}
+	return transformed
+}
+
+// headerVariables returns the variables header values can refer to: those
+// captured by the path rewrite of the route, and the built in ones, which
+// take precedence.
+func headerVariables(request *http.Request, proxy *proxyConfig, route *route, captured map[string]string) map[string]string {
+	caller := identify(request)
+	name := caller.Name
+	if named, ok := proxy.ClientNames[caller.ID]; ok && caller.ID != "" {
+		name = named
+	}
+
+	vars := make(map[string]string, len(captured)+6)
+	for key, value := range captured {
+		vars[key] = value
+	}
+	vars["client_id"] = caller.ID
+	vars["client_name"] = name
+	vars["client_ip"] = proxy.clientIP(request)
+	vars["method"] = request.Method
+	vars["request_id"] = requestIDFrom(request.Context())
+	vars["route"] = route.Name
+	return vars
+}
+
+// validHeaderName reports whether name is an RFC 9110 token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			continue
+		}
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
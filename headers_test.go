@@ -0,0 +1,261 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeaderPolicyCheck(t *testing.T) {
+
+	policy := mustHeaderPolicy(&headerPolicy{
+		Allow:          []string{"Content-Type", "X-Wallet-*", "X-Api-Key"},
+		Deny:           []string{"X-Wallet-Debug"},
+		MaxValueLength: 16,
+		Charset:        "ascii",
+		Values:         map[string]string{"x-wallet-network": "mainnet|testnet"},
+	})
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		valid  bool
+	}{
+		{"allowed", http.Header{"Content-Type": {"application/json"}, "X-Wallet-Id": {"w1"}}, true},
+		{"wildcard is case insensitive", http.Header{"x-wallet-id": {"w1"}}, true},
+		{"not allowed", http.Header{"Cookie": {"a=b"}}, false},
+		{"denied", http.Header{"X-Wallet-Debug": {"1"}}, false},
+		{"too long", http.Header{"X-Wallet-Id": {strings.Repeat("a", 17)}}, false},
+		{"line break", http.Header{"X-Wallet-Id": {"a\r\nX-Injected: 1"}}, false},
+		{"control character", http.Header{"X-Wallet-Id": {"a\x00b"}}, false},
+		{"not ascii", http.Header{"X-Wallet-Id": {"wallé"}}, false},
+		{"value pattern", http.Header{"X-Wallet-Network": {"mainnet"}}, true},
+		{"value pattern mismatch", http.Header{"X-Wallet-Network": {"regtest"}}, false},
+		{"invalid name", http.Header{"X-Wallet Id": {"w1"}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := policy.check(tc.header); (err == nil) != tc.valid {
+				t.Errorf("got %v, valid %v", err, tc.valid)
+			}
+		})
+	}
+
+}
+
+func TestHeaderPolicyApply(t *testing.T) {
+
+	policy := mustHeaderPolicy(&headerPolicy{
+		Deny:       []string{"Cookie"},
+		Disallowed: "strip",
+		Add:        map[string]string{"X-Wallet-Network": "mainnet", "Accept": "application/json"},
+		Set:        map[string]string{"X-Forwarded-Proto": "https"},
+		Remove:     []string{"X-Debug-*"},
+	})
+
+	header := http.Header{
+		"Accept":            {"text/plain"},
+		"Cookie":            {"session=1"},
+		"X-Debug-Trace":     {"1"},
+		"X-Forwarded-Proto": {"http"},
+		"X-Wallet-Id":       {"w1"},
+	}
+	if err := policy.check(header); err != nil {
+		t.Fatalf("stripped header refused: %v", err)
+	}
+
+	forwarded := policy.apply(header, nil)
+	want := http.Header{
+		"Accept":            {"text/plain"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Wallet-Id":       {"w1"},
+		"X-Wallet-Network":  {"mainnet"},
+	}
+	if len(forwarded) != len(want) {
+		t.Errorf("got headers %v want %v", forwarded, want)
+	}
+	for name, values := range want {
+		if got := forwarded.Get(name); got != values[0] {
+			t.Errorf("%s: got %q want %q", name, got, values[0])
+		}
+	}
+	// the request headers are left untouched
+	if header.Get("Cookie") == "" {
+		t.Errorf("request headers modified")
+	}
+
+}
+
+func TestResponseHeadersApply(t *testing.T) {
+
+	rules := &responseHeaders{
+		Remove: []string{"Server", "X-Powered-By", "X-Debug-*"},
+		Rename: map[string]string{"X-Backend-Version": "X-Api-Version"},
+		Add:    map[string]string{"Cache-Control": "no-store"},
+		Set:    map[string]string{"X-Request-Route": "{route}"},
+	}
+	if err := rules.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{
+		"Cache-Control":     {"max-age=60"},
+		"Content-Type":      {"application/json"},
+		"Server":            {"wallet-node/0.3"},
+		"X-Backend-Version": {"2"},
+		"X-Debug-Sql":       {"select 1"},
+		"X-Powered-By":      {"Express"},
+	}
+	got := rules.apply(header, map[string]string{"route": "wallets"})
+	want := http.Header{
+		"Cache-Control":   {"max-age=60"},
+		"Content-Type":    {"application/json"},
+		"X-Api-Version":   {"2"},
+		"X-Request-Route": {"wallets"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got headers %v want %v", got, want)
+	}
+	if header.Get("Server") == "" {
+		t.Errorf("response headers modified")
+	}
+
+	var none *responseHeaders
+	if got := none.apply(header, nil); !reflect.DeepEqual(got, header) {
+		t.Errorf("headers transformed without rules: %v", got)
+	}
+
+}
+
+func TestHeaderPolicyValidate(t *testing.T) {
+
+	for name, policy := range map[string]*headerPolicy{
+		"disallowed":    {Disallowed: "ignore"},
+		"charset":       {Charset: "utf-16"},
+		"allow name":    {Allow: []string{"X Wallet"}},
+		"value pattern": {Values: map[string]string{"X-Wallet-Id": "("}},
+		"set value":     {Set: map[string]string{"X-Wallet-Id": "a\nb"}},
+		"rename":        {Rename: map[string]string{"X-Wallet-*": "X-Id"}},
+		"response":      {Response: &responseHeaders{Set: map[string]string{"X Id": "1"}}},
+	} {
+		if err := policy.validate(); err == nil {
+			t.Errorf("%s: invalid policy accepted", name)
+		}
+	}
+
+}
+
+func TestRedirectHeaderPolicy(t *testing.T) {
+
+	var received http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer ts.Close()
+
+	t.Setenv("REDIRECT_URL", ts.URL)
+	activeConfig.Store(mustProxyConfig(t, `{
+		"routes": [{
+			"name": "wallets",
+			"path": "/wallets",
+			"headers": {"allow": ["Content-Type"], "disallowed": "strip", "set": {"X-Wallet-Route": "wallets"}}
+		}]
+	}`))
+	defer activeConfig.Store(nil)
+
+	req := httptest.NewRequest("GET", "/wallets", nil)
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set(requestIDHeader, "header-policy")
+	rr := httptest.NewRecorder()
+	newMux().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if received.Get("Cookie") != "" || received.Get("X-Wallet-Route") != "wallets" {
+		t.Errorf("policy not applied: %v", received)
+	}
+	if received.Get(requestIDHeader) != "header-policy" {
+		t.Errorf("request ID dropped by the policy")
+	}
+
+	// the default policy refuses values that could inject headers
+	req = httptest.NewRequest("GET", "/other", nil)
+	req.Header["X-Note"] = []string{"a\r\nX-Injected: 1"}
+	rr = httptest.NewRecorder()
+	newMux().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+}
+
+func TestRedirectHeaderTransforms(t *testing.T) {
+
+	var received http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Header().Set("Server", "wallet-node/0.3")
+		w.Header().Set("X-Powered-By", "Express")
+		w.Header().Set("X-Internal-Node", "10.0.0.7")
+	}))
+	defer ts.Close()
+
+	t.Setenv("REDIRECT_URL", ts.URL)
+	activeConfig.Store(mustProxyConfig(t, `{
+		"client_names": {"`+fingerprint("mobile-key")+`": "mobile-app"},
+		"routes": [{
+			"name": "wallets",
+			"path": "/wallets",
+			"headers": {
+				"set": {"X-Client-Name": "{client_name}", "X-Wallet-Tenant": "acme"},
+				"rename": {"X-Tenant": "X-Wallet-Tenant-Requested"},
+				"response": {"remove": ["Server", "X-Powered-By", "X-Internal-*"], "set": {"X-Route": "{route}"}}
+			}
+		}]
+	}`))
+	defer activeConfig.Store(nil)
+
+	for key, name := range map[string]string{"mobile-key": "mobile-app", "other-key": "x-api-key", "": "anonymous"} {
+		req := httptest.NewRequest("GET", "/wallets", nil)
+		if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		req.Header.Set("X-Tenant", "other")
+		rr := httptest.NewRecorder()
+		newMux().ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		if got := received.Get("X-Client-Name"); got != name {
+			t.Errorf("got X-Client-Name %q want %q", got, name)
+		}
+		if received.Get("X-Wallet-Tenant") != "acme" || received.Get("X-Tenant") != "" || received.Get("X-Wallet-Tenant-Requested") != "other" {
+			t.Errorf("request headers not transformed: %v", received)
+		}
+		if rr.Header().Get("Server") != "" || rr.Header().Get("X-Powered-By") != "" || rr.Header().Get("X-Internal-Node") != "" {
+			t.Errorf("sensitive response headers forwarded: %v", rr.Header())
+		}
+		if rr.Header().Get("X-Route") != "wallets" {
+			t.Errorf("response header not set: %v", rr.Header())
+		}
+	}
+
+}
+
+// mustProxyConfig loads a configuration from its JSON.
+func mustProxyConfig(t *testing.T, data string) *proxyConfig {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadProxyConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheckConfig describes the active probe sent to every upstream target.
+type healthCheckConfig struct {
+	Path               string
+	ExpectedStatus     int
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// targetStatus is a point in time view of the health of an upstream target.
+type targetStatus struct {
+	URL                  string    `json:"url"`
+	Healthy              bool      `json:"healthy"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	LastStatus           int       `json:"last_status,omitempty"`
+	LastError            string    `json:"last_error,omitempty"`
+	LastCheck            time.Time `json:"last_check"`
+}
+
+type upstreamTarget struct {
+	mu     sync.Mutex
+	status targetStatus
+}
+
+// healthChecker probes the upstream targets in the background and keeps
+// track of which of them can receive traffic.
+type healthChecker struct {
+	config healthCheckConfig
+	client *http.Client
+	stop   chan struct{}
+	done   chan struct{}
+
+	mu      sync.Mutex
+	targets []*upstreamTarget
+}
+
+// checker is the health checker of the running service, nil when active
+// health checking is disabled.
+var checker *healthChecker
+
+func healthCheckConfigFromEnv() (healthCheckConfig, error) {
+	config := healthCheckConfig{
+		Path:               os.Getenv("HEALTH_CHECK_PATH"),
+		ExpectedStatus:     http.StatusOK,
+		Interval:           10 * time.Second,
+		Timeout:            2 * time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+
+	var err error
+	if config.ExpectedStatus, err = envInt("HEALTH_CHECK_EXPECTED_STATUS", config.ExpectedStatus); err != nil {
+		return config, err
+	}
+	if config.Interval, err = envDuration("HEALTH_CHECK_INTERVAL", config.Interval); err != nil {
+		return config, err
+	}
+	if config.Timeout, err = envDuration("HEALTH_CHECK_TIMEOUT", config.Timeout); err != nil {
+		return config, err
+	}
+	if config.HealthyThreshold, err = envInt("HEALTH_CHECK_HEALTHY_THRESHOLD", config.HealthyThreshold); err != nil {
+		return config, err
+	}
+	if config.UnhealthyThreshold, err = envInt("HEALTH_CHECK_UNHEALTHY_THRESHOLD", config.UnhealthyThreshold); err != nil {
+		return config, err
+	}
+
+	if config.Path != "" && !strings.HasPrefix(config.Path, "/") {
+		return config, fmt.Errorf("HEALTH_CHECK_PATH must start with /")
+	}
+	if config.Interval <= 0 || config.Timeout <= 0 {
+		return config, fmt.Errorf("health check interval and timeout must be positive")
+	}
+	if config.HealthyThreshold < 1 || config.UnhealthyThreshold < 1 {
+		return config, fmt.Errorf("health check thresholds must be at least 1")
+	}
+
+	return config, nil
+}
+
+// newHealthChecker returns a checker for the given targets, or nil when no
+// probe path is configured.
+func newHealthChecker(config healthCheckConfig, targets ...string) *healthChecker {
+	if config.Path == "" || len(targets) == 0 {
+		return nil
+	}
+
+	hc := &healthChecker{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	hc.setTargets(targets...)
+	return hc
+}
+
+// setTargets replaces the checked targets, keeping the state of the ones
+// that were already checked.
+func (hc *healthChecker) setTargets(targets ...string) {
+	if hc == nil {
+		return
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	existing := map[string]*upstreamTarget{}
+	for _, t := range hc.targets {
+		existing[t.status.URL] = t
+	}
+	hc.targets = nil
+	for _, target := range targets {
+		t, ok := existing[target]
+		if !ok {
+			// targets start healthy so traffic is not refused before the first probe
+			t = &upstreamTarget{status: targetStatus{URL: target, Healthy: true}}
+		}
+		hc.targets = append(hc.targets, t)
+	}
+}
+
+// snapshot returns the targets being checked.
+func (hc *healthChecker) snapshot() []*upstreamTarget {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.targets
+}
+
+// start probes every target once and then keeps probing them every interval
+// until close is called.
+func (hc *healthChecker) start() {
+	go func() {
+		defer close(hc.done)
+
+		ticker := time.NewTicker(hc.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			hc.probeAll()
+			select {
+			case <-hc.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (hc *healthChecker) close() {
+	if hc == nil {
+		return
+	}
+	close(hc.stop)
+	<-hc.done
+}
+
+func (hc *healthChecker) probeAll() {
+	var wg sync.WaitGroup
+	for _, target := range hc.snapshot() {
+		wg.Add(1)
+		go func(target *upstreamTarget) {
+			defer wg.Done()
+			hc.probe(target)
+		}(target)
+	}
+	wg.Wait()
+}
+
+func (hc *healthChecker) probe(target *upstreamTarget) {
+	target.mu.Lock()
+	probeURL := target.status.URL + hc.config.Path
+	target.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), hc.config.Timeout)
+	defer cancel()
+
+	var status int
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = hc.client.Do(req)
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			status = resp.StatusCode
+			if status != hc.config.ExpectedStatus {
+				err = fmt.Errorf("unexpected status %d", status)
+			}
+		}
+	}
+
+	target.mu.Lock()
+	defer target.mu.Unlock()
+
+	s := &target.status
+	s.LastCheck = time.Now()
+	s.LastStatus = status
+	if err != nil {
+		s.LastError = err.Error()
+		s.ConsecutiveSuccesses = 0
+		s.ConsecutiveFailures++
+		if s.Healthy && s.ConsecutiveFailures >= hc.config.UnhealthyThreshold {
+			s.Healthy = false
+			slog.Warn("Upstream marked unhealthy", "target", s.URL, "error", err)
+		}
+		return
+	}
+
+	s.LastError = ""
+	s.ConsecutiveFailures = 0
+	s.ConsecutiveSuccesses++
+	if !s.Healthy && s.ConsecutiveSuccesses >= hc.config.HealthyThreshold {
+		s.Healthy = true
+		slog.Info("Upstream marked healthy", "target", s.URL)
+	}
+}
+
+// healthy reports whether the target can receive traffic. Targets that are
+// not health checked are always considered healthy.
+func (hc *healthChecker) healthy(target string) bool {
+	if hc == nil {
+		return true
+	}
+	for _, t := range hc.snapshot() {
+		t.mu.Lock()
+		url, healthy := t.status.URL, t.status.Healthy
+		t.mu.Unlock()
+		if url == target {
+			return healthy
+		}
+	}
+	return true
+}
+
+// statuses returns a snapshot of the health of every target.
+func (hc *healthChecker) statuses() []targetStatus {
+	if hc == nil {
+		return nil
+	}
+	targets := hc.snapshot()
+	statuses := make([]targetStatus, 0, len(targets))
+	for _, t := range targets {
+		t.mu.Lock()
+		statuses = append(statuses, t.status)
+		t.mu.Unlock()
+	}
+	return statuses
+}
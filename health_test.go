@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckerThresholds(t *testing.T) {
+
+	// Create a test server whose health endpoint can be switched on and off
+	var failing atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	hc := newHealthChecker(healthCheckConfig{
+		Path:               "/health",
+		ExpectedStatus:     http.StatusOK,
+		Interval:           time.Hour,
+		Timeout:            time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+	}, ts.URL)
+
+	failing.Store(true)
+	hc.probeAll()
+	if !hc.healthy(ts.URL) {
+		t.Errorf("target marked unhealthy before reaching the unhealthy threshold")
+	}
+	hc.probeAll()
+	if hc.healthy(ts.URL) {
+		t.Errorf("target still healthy after reaching the unhealthy threshold")
+	}
+
+	status := hc.statuses()[0]
+	if status.LastStatus != http.StatusServiceUnavailable || status.ConsecutiveFailures != 2 {
+		t.Errorf("unexpected target status: %+v", status)
+	}
+
+	failing.Store(false)
+	hc.probeAll()
+	if hc.healthy(ts.URL) {
+		t.Errorf("target marked healthy before reaching the healthy threshold")
+	}
+	hc.probeAll()
+	if !hc.healthy(ts.URL) {
+		t.Errorf("target still unhealthy after reaching the healthy threshold")
+	}
+
+}
+
+func TestHealthCheckerDisabled(t *testing.T) {
+
+	hc := newHealthChecker(healthCheckConfig{}, "http://localhost")
+	if hc != nil {
+		t.Fatalf("health checker created without a probe path")
+	}
+
+	// a disabled checker lets every target through
+	if !hc.healthy("http://localhost") {
+		t.Errorf("disabled health checker reported an unhealthy target")
+	}
+
+}
+
+func TestRedirectUnhealthyUpstream(t *testing.T) {
+
+	// Create a test server that always fails its health check
+	var proxied atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		proxied.Store(true)
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checker = newHealthChecker(healthCheckConfig{
+		Path:               "/health",
+		ExpectedStatus:     http.StatusOK,
+		Interval:           time.Hour,
+		Timeout:            time.Second,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	}, ts.URL)
+	defer func() { checker = nil }()
+	checker.probeAll()
+
+	req := httptest.NewRequest("GET", "/redirect", nil)
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(redirect)
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusServiceUnavailable)
+	}
+
+	if proxied.Load() {
+		t.Errorf("request was forwarded to an unhealthy upstream")
+	}
+
+}
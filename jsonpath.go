@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a parsed JSONPath expression, restricted to the forms that
+// select fields: $.a.b, $['a'], $.a[*], $.a.*, $.a[0] and $..a.
+type jsonPath struct {
+	expr  string
+	steps []pathStep
+}
+
+type pathStep struct {
+	// kind is child, wildcard, index or descendant.
+	kind  string
+	name  string
+	index int
+}
+
+// parseJSONPath parses expr, which must start at the root $.
+func parseJSONPath(expr string) (*jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("json path %s: must start with $", expr)
+	}
+	p := &jsonPath{expr: expr}
+	rest := expr[1:]
+	for rest != "" {
+		var step pathStep
+		var err error
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			rest = rest[2:]
+			step.kind = "descendant"
+			step.name, rest = cutName(rest)
+		case strings.HasPrefix(rest, ".*"):
+			rest = rest[2:]
+			step.kind = "wildcard"
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			step.kind = "child"
+			step.name, rest = cutName(rest)
+		case strings.HasPrefix(rest, "[*]"):
+			rest = rest[3:]
+			step.kind = "wildcard"
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, fmt.Errorf("json path %s: unterminated ['", expr)
+			}
+			step.kind = "child"
+			step.name, rest = rest[2:end], rest[end+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("json path %s: unterminated [", expr)
+			}
+			step.kind = "index"
+			if step.index, err = strconv.Atoi(rest[1:end]); err != nil || step.index < 0 {
+				return nil, fmt.Errorf("json path %s: invalid index %s", expr, rest[1:end])
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("json path %s: unexpected %q", expr, rest)
+		}
+		if (step.kind == "child" || step.kind == "descendant") && step.name == "" {
+			return nil, fmt.Errorf("json path %s: missing field name", expr)
+		}
+		p.steps = append(p.steps, step)
+	}
+	if len(p.steps) == 0 {
+		return nil, fmt.Errorf("json path %s: selects the whole document", expr)
+	}
+	return p, nil
+}
+
+// cutName splits a dotted field name from the rest of a path.
+func cutName(s string) (string, string) {
+	end := strings.IndexAny(s, ".[")
+	if end < 0 {
+		return s, ""
+	}
+	return s[:end], s[end:]
+}
+
+// lastField returns the field name selected by the last step, empty when
+// it isn't a named field.
+func (p *jsonPath) lastField() string {
+	last := p.steps[len(p.steps)-1]
+	if last.kind == "child" || last.kind == "descendant" {
+		return last.name
+	}
+	return ""
+}
+
+// locations returns the keys leading from document to every value the
+// path selects: strings for object members, ints for array elements.
+func (p *jsonPath) locations(document any) [][]any {
+	var found [][]any
+	var walk func(node any, steps []pathStep, at []any)
+	walk = func(node any, steps []pathStep, at []any) {
+		if len(steps) == 0 {
+			found = append(found, append([]any(nil), at...))
+			return
+		}
+		step, next := steps[0], steps[1:]
+		switch step.kind {
+		case "child":
+			if object, ok := node.(map[string]any); ok {
+				if value, ok := object[step.name]; ok {
+					walk(value, next, append(at, step.name))
+				}
+			}
+		case "index":
+			if array, ok := node.([]any); ok && step.index < len(array) {
+				walk(array[step.index], next, append(at, step.index))
+			}
+		case "wildcard":
+			switch container := node.(type) {
+			case map[string]any:
+				for _, key := range sortedKeys(container) {
+					walk(container[key], next, append(at, key))
+				}
+			case []any:
+				for i, value := range container {
+					walk(value, next, append(at, i))
+				}
+			}
+		case "descendant":
+			// the field on this node, then on every node below it
+			if object, ok := node.(map[string]any); ok {
+				if value, ok := object[step.name]; ok {
+					walk(value, next, append(at, step.name))
+				}
+			}
+			switch container := node.(type) {
+			case map[string]any:
+				for _, key := range sortedKeys(container) {
+					walk(container[key], steps, append(at, key))
+				}
+			case []any:
+				for i, value := range container {
+					walk(value, steps, append(at, i))
+				}
+			}
+		}
+	}
+	walk(document, p.steps, nil)
+	return found
+}
+
+func sortedKeys(object map[string]any) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// valueAt returns the value of document at the location.
+func valueAt(document any, location []any) any {
+	for _, key := range location {
+		switch key := key.(type) {
+		case string:
+			document = document.(map[string]any)[key]
+		case int:
+			document = document.([]any)[key]
+		}
+	}
+	return document
+}
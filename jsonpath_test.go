@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSONPathLocations(t *testing.T) {
+
+	var document any
+	if err := json.Unmarshal([]byte(`{
+		"id": 1,
+		"wallet": {"db_id": 7, "name": "main", "node": {"url": "http://10.0.0.7"}},
+		"items": [{"db_id": 8, "amount": 1}, {"amount": 2}],
+		"odd key": true
+	}`), &document); err != nil {
+		t.Fatal(err)
+	}
+
+	for expr, want := range map[string][][]any{
+		"$.id":             {{"id"}},
+		"$.wallet.name":    {{"wallet", "name"}},
+		"$['odd key']":     {{"odd key"}},
+		"$.items[1]":       {{"items", 1}},
+		"$.items[5]":       nil,
+		"$.items[*].db_id": {{"items", 0, "db_id"}},
+		"$.wallet.*":       {{"wallet", "db_id"}, {"wallet", "name"}, {"wallet", "node"}},
+		"$..db_id":         {{"items", 0, "db_id"}, {"wallet", "db_id"}},
+		"$..node.url":      {{"wallet", "node", "url"}},
+		"$.missing.id":     nil,
+	} {
+		path, err := parseJSONPath(expr)
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+			continue
+		}
+		if got := path.locations(document); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v want %v", expr, got, want)
+		}
+	}
+
+}
+
+func TestParseJSONPathInvalid(t *testing.T) {
+
+	for _, expr := range []string{"", "$", "id", "$.", "$..", "$[", "$['id'", "$[-1]", "$[a]", "$.a b["} {
+		if _, err := parseJSONPath(expr); err == nil {
+			t.Errorf("%q: invalid path accepted", expr)
+		}
+	}
+
+}
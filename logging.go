@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newLogger returns a logger writing records at or above level to w, as
+// JSON or as logfmt style text.
+func newLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	options := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q, must be json or text", format)
+}
+
+// fatal logs an error that prevents the service from starting and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// loggerFrom returns the logger of the request the context belongs to, or
+// the default logger.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// logRequests gives every request a logger carrying its route and client,
+// and logs the outcome of the request once it is answered.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		proxy := proxyConfigFrom(request.Context())
+		c := identify(request)
+
+		logger := slog.Default().With(
+			"request_id", requestIDFrom(request.Context()),
+			"route", proxy.match(request).Name,
+			"method", request.Method,
+			"path", request.URL.Path,
+			"client", c.Name,
+			"client_id", c.ID,
+			"remote_ip", proxy.clientIP(request),
+		)
+		if span := trace.SpanContextFromContext(request.Context()); span.IsValid() {
+			logger = logger.With("trace_id", span.TraceID().String())
+		}
+		request = request.WithContext(context.WithValue(request.Context(), loggerKey{}, logger))
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, request)
+
+		level := slog.LevelInfo
+		if recorder.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if recorder.status >= http.StatusBadRequest {
+			level = slog.LevelWarn
+		}
+		logger.Log(request.Context(), level, "request",
+			"status", recorder.status,
+			"duration", time.Since(start),
+			"bytes", recorder.written,
+		)
+	})
+}
+
+// sensitiveHeaders are never written to the logs.
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie", "X-Api-Key"}
+
+// redactHeaders returns a copy of the headers safe to log.
+func redactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range sensitiveHeaders {
+		if _, ok := redacted[name]; ok {
+			redacted[name] = []string{"REDACTED"}
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends the default logger to a buffer for the rest of the test.
+func captureLogs(t *testing.T, level string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	logger, err := newLogger(buf, level, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return buf
+}
+
+func TestNewLoggerInvalid(t *testing.T) {
+
+	if _, err := newLogger(new(bytes.Buffer), "verbose", "json"); err == nil {
+		t.Errorf("invalid level accepted")
+	}
+	if _, err := newLogger(new(bytes.Buffer), "info", "xml"); err == nil {
+		t.Errorf("invalid format accepted")
+	}
+	if _, err := newLogger(new(bytes.Buffer), "DEBUG", "TEXT"); err != nil {
+		t.Errorf("valid configuration refused: %v", err)
+	}
+
+}
+
+func TestLogRequests(t *testing.T) {
+
+	// Create a test server that returns a predefined response
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := captureLogs(t, "info")
+
+	req := httptest.NewRequest("GET", "/wallets/1", nil)
+	req.Header.Set("X-Api-Key", "secret-key")
+	rr := httptest.NewRecorder()
+	newMux().ServeHTTP(rr, req)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected a single log line at info level, got %d: %s", len(lines), logs)
+	}
+
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]any{
+		"msg":       "request",
+		"route":     "default",
+		"method":    "GET",
+		"path":      "/wallets/1",
+		"client":    "x-api-key",
+		"client_id": fingerprint("secret-key"),
+		"status":    float64(http.StatusAccepted),
+	} {
+		if record[key] != want {
+			t.Errorf("%s: got %v want %v", key, record[key], want)
+		}
+	}
+	if _, ok := record["duration"]; !ok {
+		t.Errorf("duration not logged")
+	}
+
+	if strings.Contains(logs.String(), "secret-key") {
+		t.Errorf("api key written to the logs")
+	}
+
+}
+
+func TestLogRequestsDebugHeaders(t *testing.T) {
+
+	// Create a test server that returns a predefined response
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := captureLogs(t, "debug")
+
+	req := httptest.NewRequest("GET", "/wallets/1", nil)
+	req.Header.Set("X-Api-Key", "secret-key")
+	req.Header.Set("X-Wallet", "visible")
+	newMux().ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.Contains(logs.String(), "Headers from redirect") || !strings.Contains(logs.String(), "visible") {
+		t.Errorf("headers not logged at debug level: %s", logs)
+	}
+	if strings.Contains(logs.String(), "secret-key") {
+		t.Errorf("api key written to the logs")
+	}
+
+}
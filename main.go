@@ -4,232 +4,469 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
 
-	http.HandleFunc("/", redirect)
-	err := http.ListenAndServe("0.0.0.0:8080", nil)
+	// the .env file is optional, the environment may already be set
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fatal("Error loading .env file", err)
+	}
+
+	config, err := parseServerConfig(os.Args[1:])
 	if err != nil {
-		return
+		fatal("Invalid server configuration", err)
 	}
 
-}
+	logger, err := newLogger(os.Stderr, config.LogLevel, config.LogFormat)
+	if err != nil {
+		fatal("Invalid logging configuration", err)
+	}
+	slog.SetDefault(logger)
 
-func redirect(writer http.ResponseWriter, request *http.Request) {
+	healthCheck, err := healthCheckConfigFromEnv()
+	if err != nil {
+		fatal("Invalid health check configuration", err)
+	}
+	shutdown, err := shutdownConfigFromEnv()
+	if err != nil {
+		fatal("Invalid shutdown configuration", err)
+	}
 
-	env := godotenv.Load()
-	if env != nil {
-		log.Fatalln("Error loading .env file")
+	accessLogging, err := accessLogConfigFromEnv()
+	if err != nil {
+		fatal("Invalid access log configuration", err)
 	}
+	accessLog = newAccessLogger(accessLogging)
 
-	redirectURL := os.Getenv("REDIRECT_URL")
+	auditOutput := envString("AUDIT_LOG", "off")
+	auditLog, err = newAuditLogger(auditOutput)
+	if err != nil {
+		fatal("Invalid audit log configuration", err)
+	}
 
-	// if the redirectURL isn't set, return an error
-	if redirectURL == "" {
-		http.Error(writer, "REDIRECT_URL environment variable not set", http.StatusInternalServerError)
-		return
+	proxy, err := loadProxyConfig(config.ConfigFile)
+	if err != nil {
+		fatal("Invalid configuration file", err)
+	}
+	// an upstream no request could be forwarded to is refused right away
+	if redirectURL := proxy.redirectURL(); redirectURL != "" {
+		if _, err := parseUpstream(redirectURL); err != nil {
+			fatal("Invalid REDIRECT_URL", err)
+		}
 	}
+	activeConfig.Store(proxy)
 
-	// append the path of the original request to the redirectURL
-	redirectURL += request.URL.Path
+	checker = newHealthChecker(healthCheck, proxy.redirectURL())
+	if checker != nil {
+		checker.start()
+	}
 
-	// Validate the redirectURL
-	if err := validateUrl(redirectURL); err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
-		return
+	listener, err := listen(config.Listen)
+	if err != nil {
+		fatal("Error opening listener", err)
 	}
+	servers := []listening{{newServer(config, newMux()), listener}}
 
-	log.Println(fmt.Sprintf("Headers from redirect: %v", request.Header))
-	// Validate the headers
-	for key := range request.Header {
-		key = http.CanonicalHeaderKey(key)
-		log.Println(fmt.Sprintf("Header from redirect: %v", key))
-		if err := validateInput(key); err != nil {
-			http.Error(writer, fmt.Sprintf("Invalid header key: %s", key), http.StatusBadRequest)
-			return
+	if config.AdminListen != "" {
+		adminListener, err := listen(config.AdminListen)
+		if err != nil {
+			fatal("Error opening admin listener", err)
 		}
+		servers = append(servers, listening{newServer(config, newAdminMux(runtimeSettings{config, healthCheck, shutdown, accessLogging, auditOutput})), adminListener})
 	}
 
-	queryParams := request.URL.Query()
-	if queryParams != nil {
-		if err := validateQueryParameters(queryParams); err != nil {
-			http.Error(writer, err.Error(), http.StatusBadRequest)
-			return
-		}
-		redirectURL += "?" + queryParams.Encode()
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		fatal("Invalid tracing configuration", err)
 	}
 
-	// set its timeout
-	client := &http.Client{
-		Timeout: time.Second * 60,
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	reloader := newConfigReloader(config.ConfigFile, config.ConfigWatchInterval)
+	reloader.start(hangups)
+
+	code := serve(signals, shutdown, servers...)
+	reloader.close()
+
+	// flush the spans of the drained requests
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Error flushing spans", "error", err)
 	}
+	if err := accessLog.close(); err != nil {
+		slog.Error("Error closing the access log", "error", err)
+	}
+	if err := auditLog.close(); err != nil {
+		slog.Error("Error closing the audit log", "error", err)
+	}
+	os.Exit(code)
 
-	// make a request to the redirectURL based on the method of the original request
-	var resp *http.Response
-	switch request.Method {
+}
 
-	case http.MethodGet:
+// newMux routes the probe endpoints to the service and everything else to
+// the upstream. Paths reach the upstream handler as they came: http.ServeMux
+// would answer paths it cleans, such as those with dot segments, with a
+// redirect instead of letting them be refused.
+func newMux() http.Handler {
+	proxy := newProxyHandler()
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		path, err := normalizePath(request.URL.EscapedPath())
+		switch {
+		case err == nil && path == livenessPath:
+			healthz(writer, request)
+		case err == nil && path == readinessPath:
+			readyz(writer, request)
+		default:
+			proxy.ServeHTTP(writer, request)
+		}
+	})
+}
 
-		req, _ := http.NewRequest(http.MethodGet, redirectURL, nil)
-		log.Println(fmt.Sprintf("Request from redirect: %v", req))
+// newProxyHandler returns the handler forwarding requests upstream, with
+// its middlewares. Paths are normalized before any of them routes them.
+func newProxyHandler() http.Handler {
+	return withProxyConfig(requestIDs(normalizePaths(accessLogs(traceRequests(logRequests(instrument(handleCORS(http.HandlerFunc(redirect)))))))))
+}
 
-		ctx, cancel := context.WithTimeout(req.Context(), 60*time.Second)
-		req = req.WithContext(ctx)
-		req.Header = request.Header
-		header := validateApiKey(request.URL.Query().Get("api-key"), request.Header.Get("x-api-key"))
-		req.Header.Set("x-api-key", header)
+func redirect(writer http.ResponseWriter, request *http.Request) {
 
-		resp, _ = client.Do(req)
+	logger := loggerFrom(request.Context())
+	proxy := proxyConfigFrom(request.Context())
 
-		cancel()
-	case http.MethodPost:
+	redirectURL := proxy.redirectURL()
 
-		buf := new(bytes.Buffer)
-		_, err := buf.ReadFrom(request.Body)
-		if err != nil {
-			http.Error(writer, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
-			return
-		}
+	// if the redirectURL isn't set, return an error
+	if redirectURL == "" {
+		httpError(writer, request, "REDIRECT_URL environment variable not set", http.StatusInternalServerError)
+		return
+	}
 
-		if buf.Len() == 0 {
-			http.Error(writer, "Request body is empty", http.StatusBadRequest)
-			return
-		}
+	// don't send traffic to an upstream that is failing its health checks
+	if !checker.healthy(redirectURL) {
+		httpError(writer, request, "Upstream unavailable", http.StatusServiceUnavailable)
+		return
+	}
 
-		req, _ := http.NewRequest(http.MethodPost, redirectURL, buf)
-		log.Println(fmt.Sprintf("Request from redirect: %v", req))
+	// the path was normalized by normalizePaths, or found invalid
+	if err := pathError(request.Context()); err != nil {
+		rejected(defaultRoute, request, "normalizePath")
+		httpError(writer, request, fmt.Sprintf("Invalid path: %v", err), http.StatusBadRequest)
+		return
+	}
+	route := proxy.match(request)
 
-		ctx, cancel := context.WithTimeout(req.Context(), 60*time.Second)
-		req = req.WithContext(ctx)
-		req.Header = request.Header
-		header := validateApiKey(request.URL.Query().Get("api-key"), request.Header.Get("x-api-key"))
-		log.Println(fmt.Printf("Header: %v\n", request.URL.Query().Get("api-key")))
-		req.Header.Set("x-api-key", header)
+	if !allowRequest(writer, request, proxy, route) {
+		rateLimited.WithLabelValues(route.Name, methodLabel(request.Method)).Inc()
+		return
+	}
 
-		resp, err = client.Do(req)
-		cancel()
-	case http.MethodPut:
+	// the path forwarded upstream, and the variables it was rewritten with
+	path, vars, err := rewrite(route.Rewrite, request.URL.EscapedPath())
+	if err != nil {
+		rejected(route, request, "rewrite")
+		httpError(writer, request, fmt.Sprintf("Invalid path: %v", err), http.StatusBadRequest)
+		return
+	}
 
-		buf := new(bytes.Buffer)
-		_, err := buf.ReadFrom(request.Body)
-		if err != nil {
-			http.Error(writer, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
-			return
-		}
+	_, span := tracer().Start(request.Context(), "validate")
+	redirectURL, ok := validateRequest(writer, request, proxy, route, redirectURL, path)
+	endSpan(span, ok, "invalid request")
+	if !ok {
+		return
+	}
 
-		if buf.Len() == 0 {
-			http.Error(writer, "Request body is empty", http.StatusBadRequest)
+	// cap the size of the body before anything reads it
+	maxBodyBytes := proxy.maxBodyBytes(route)
+	if request.ContentLength > maxBodyBytes {
+		rejected(route, request, "readBody")
+		httpError(writer, request, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	request.Body = http.MaxBytesReader(writer, request.Body, maxBodyBytes)
+
+	// read the body before taking an upstream slot, so slow clients don't
+	// hold one while they upload
+	var body io.Reader
+	switch request.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		content := proxy.contentPolicy(route)
+		var mediaType, charset string
+		if content != nil {
+			var err error
+			if mediaType, charset, err = content.checkContentType(request.Header.Get("Content-Type")); err != nil {
+				rejected(route, request, "contentType")
+				httpError(writer, request, err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		buf, ok := readBody(writer, request)
+		if !ok {
+			rejected(route, request, "readBody")
 			return
 		}
+		if content != nil {
+			if err := checkBodyContent(buf.Bytes(), mediaType, charset); err != nil {
+				rejected(route, request, "contentType")
+				httpError(writer, request, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if route.bodySchema != nil {
+			if violations := route.checkBody(buf.Bytes()); len(violations) > 0 {
+				rejected(route, request, "bodySchema")
+				violationsError(writer, request, "Invalid request body", http.StatusUnprocessableEntity, violations)
+				return
+			}
+		}
+		body = buf
+	default:
+		httpError(writer, request, "Invalid request method", http.StatusBadRequest)
+		return
+	}
 
-		req, _ := http.NewRequest(http.MethodPut, redirectURL, buf)
-		log.Println(fmt.Sprintf("Request from redirect: %v", req))
+	release, ok := acquireSlot(writer, request, proxy, route)
+	if !ok {
+		return
+	}
+	defer release()
 
-		ctx, cancel := context.WithTimeout(req.Context(), 60*time.Second)
-		req = req.WithContext(ctx)
-		req.Header = request.Header
-		header := validateApiKey(request.URL.Query().Get("api-key"), request.Header.Get("x-api-key"))
-		req.Header.Set("x-api-key", header)
+	// set its timeout
+	client := &http.Client{
+		Timeout: time.Second * 60,
+	}
 
-		resp, err = client.Do(req)
-		cancel()
-	default:
-		http.Error(writer, "Invalid request method", http.StatusBadRequest)
+	// make a request to the redirectURL with the method of the original request
+	ctx, cancel := context.WithTimeout(request.Context(), 60*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, request.Method, redirectURL, body)
+	logger.Debug("Request to remote", "url", req.URL.Redacted())
+
+	_, span = tracer().Start(request.Context(), "authenticate")
+	header, reason := validateApiKey(proxy, request.URL.Query().Get("api-key"), request.Header.Get("x-api-key"))
+	if reason != "" {
+		authFailures.WithLabelValues(route.Name, methodLabel(request.Method), reason).Inc()
+		span.SetAttributes(attribute.String("auth.failure_reason", reason))
+	}
+	endSpan(span, reason == "", reason)
+	auditLog.record(request, proxy, route, reason)
+
+	// from here on the request carries the headers sent upstream
+	vars = headerVariables(request, proxy, route, vars)
+	request.Header = proxy.headerPolicy(route).apply(request.Header, vars)
+	req.Header = request.Header
+	// the headers of the proxy itself are never dropped by the policy
+	if id := requestIDFrom(request.Context()); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	req.Header.Set("x-api-key", header)
+	// responses to transform must come uncompressed, so the encodings of
+	// the client aren't asked for; the transport still asks for gzip and
+	// decodes it
+	if route.ResponseBody != nil {
+		req.Header.Del("Accept-Encoding")
+	}
+
+	ctx, span = tracer().Start(ctx, "upstream "+request.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(request.Method),
+			semconv.ServerAddress(req.URL.Hostname()),
+			semconv.URLPath(req.URL.Path),
+		),
+	)
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	result := upstreamResultFrom(request.Context())
+	result.latency = time.Since(start)
+	upstreamDuration.WithLabelValues(route.Name, methodLabel(request.Method)).Observe(result.latency.Seconds())
+	if err != nil {
+		span.RecordError(err)
+		endSpan(span, false, "upstream request failed")
+		upstreamResponses.WithLabelValues(route.Name, methodLabel(request.Method), "error").Inc()
+		logger.Error("Error from remote", "error", err)
+		httpError(writer, request, "Error forwarding request", http.StatusBadGateway)
 		return
 	}
+	result.status = resp.StatusCode
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	endSpan(span, resp.StatusCode < http.StatusInternalServerError, http.StatusText(resp.StatusCode))
 
-	log.Println(fmt.Sprintf("Response from remote: %v", resp))
+	upstreamResponses.WithLabelValues(route.Name, methodLabel(request.Method), strconv.Itoa(resp.StatusCode)).Inc()
+	logger.Debug("Response from remote", "status", resp.StatusCode, "headers", redactHeaders(resp.Header))
 
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
 		if err != nil {
-			http.Error(writer, fmt.Sprintf("Error catch body from request: %s", err), http.StatusInternalServerError)
+			httpError(writer, request, fmt.Sprintf("Error catch body from request: %s", err), http.StatusInternalServerError)
 		}
 	}(resp.Body)
 
-	// copy the headers of the response
-	for k, v := range resp.Header {
+	// copy the headers of the response, as transformed by the route
+	for k, v := range proxy.headerPolicy(route).Response.apply(resp.Header, vars) {
 		writer.Header().Set(k, v[0])
 	}
 
+	// JSON bodies are transformed whole, anything else is streamed
+	responseBody, length := route.ResponseBody.body(resp)
+	if length >= 0 {
+		writer.Header().Set("Content-Length", strconv.Itoa(length))
+		// the upstream's validators describe the body it sent
+		writer.Header().Del("ETag")
+		writer.Header().Del("Content-MD5")
+	}
+
 	// copy the status code of the response
 	writer.WriteHeader(resp.StatusCode)
 
 	// copy the response body to the client
-	_, _ = io.Copy(writer, resp.Body)
+	_, _ = io.Copy(writer, responseBody)
 
 }
 
-func validateUrl(redirectUrl string) error {
-	u, err := url.ParseRequestURI(redirectUrl)
+// validateRequest checks the URL the request is forwarded to, the header
+// keys and the query parameters. It returns the upstream URL, or answers
+// the request itself and returns false when something is invalid.
+func validateRequest(writer http.ResponseWriter, request *http.Request, proxy *proxyConfig, route *route, redirectURL string, path string) (string, bool) {
+	logger := loggerFrom(request.Context())
+
+	// append the normalized, maybe rewritten, path to the redirectURL
+	target, err := joinUpstream(redirectURL, path)
 	if err != nil {
-		return fmt.Errorf("invalid url: %v", err)
+		rejected(route, request, "validateUrl")
+		httpError(writer, request, err.Error(), http.StatusBadRequest)
+		return "", false
 	}
-	if !u.IsAbs() {
-		return fmt.Errorf("url must be absolute")
+
+	logger.Debug("Headers from redirect", "headers", redactHeaders(request.Header))
+	if err := proxy.headerPolicy(route).check(request.Header); err != nil {
+		rejected(route, request, "headerPolicy")
+		logger.Info("Invalid header", "error", err)
+		httpError(writer, request, err.Error(), http.StatusBadRequest)
+		return "", false
 	}
-	return nil
-}
 
-func validateQueryParameters(queryParams url.Values) error {
-	// Define a regular expression
-	pattern := `^[a-zA-Z0-9:_/?-]+$`
-	valid := regexp.MustCompile(pattern)
+	if content := proxy.contentPolicy(route); content != nil && !content.acceptable(request.Header.Get("Accept")) {
+		rejected(route, request, "accept")
+		httpError(writer, request, "Not acceptable, the route produces "+strings.Join(content.Produces, ", "), http.StatusNotAcceptable)
+		return "", false
+	}
 
-	// Validate the key parameters
-	for key := range queryParams {
-		if !valid.MatchString(key) {
-			return fmt.Errorf("invalid query parameters: %v", key)
+	queryParams, err := url.ParseQuery(request.URL.RawQuery)
+	if err != nil && proxy.forwardQuery(route) == "raw" {
+		// the pairs that don't parse would be forwarded unchecked
+		rejected(route, request, "validateQueryParameters")
+		httpError(writer, request, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		return "", false
+	}
+	if route.Query != nil {
+		if violations := route.Query.check(queryParams); len(violations) > 0 {
+			rejected(route, request, "querySchema")
+			violationsError(writer, request, "Invalid query parameters", http.StatusBadRequest, violations)
+			return "", false
 		}
+	} else if err := validateQueryParameters(queryParams); err != nil {
+		rejected(route, request, "validateQueryParameters")
+		httpError(writer, request, err.Error(), http.StatusBadRequest)
+		return "", false
 	}
+	// url.URL leaves the ? out when the query is empty
+	target.RawQuery = upstreamQuery(proxy.forwardQuery(route), request.URL.RawQuery, queryParams)
 
-	return nil
+	return target.String(), true
 }
 
-func validateInput(input string) error {
-	// Define a regular expression
-	pattern := `^[a-zA-Z0-9:_/?-]+$`
-	r := regexp.MustCompile(pattern)
+// readBody reads the whole request body, answering the request itself when
+// the body can't be read, is empty or is over the size limit.
+func readBody(writer http.ResponseWriter, request *http.Request) (*bytes.Buffer, bool) {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(request.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(writer, request, "Request body too large", http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		httpError(writer, request, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if buf.Len() == 0 {
+		httpError(writer, request, "Request body is empty", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return buf, true
+}
+
+// queryKeyPattern is the set of characters accepted in query parameter
+// names.
+var queryKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9:_/?-]+$`)
 
-	// Validate the input
-	if !r.MatchString(input) {
-		return fmt.Errorf("invalid input")
+func validateQueryParameters(queryParams url.Values) error {
+	// Validate the key parameters
+	for key := range queryParams {
+		if !queryKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid query parameters: %v", key)
+		}
 	}
 
 	return nil
 }
 
-func validateApiKey(apiKey string, xApiKey string) string {
+// validateApiKey returns the x-api-key to send upstream. When the api-key
+// query parameter is refused it also returns the reason.
+func validateApiKey(proxy *proxyConfig, apiKey string, xApiKey string) (string, string) {
 
-	apiKeyURL := os.Getenv("X_API_KEY")
+	apiKeyURL := proxy.secret("X_API_KEY")
 
 	if apiKey != "" {
-		token := os.Getenv("TOKEN")
+		token := proxy.secret("TOKEN")
+		if token == "" {
+			return "", "token_not_configured"
+		}
 		data := []byte(token)
 		sum := md5.Sum(data)
 
-		log.Println(fmt.Sprintf("Token: %v", token))
-		log.Println(fmt.Sprintf("Sum: %v", fmt.Sprintf("%x", sum)))
-		log.Println(fmt.Sprintf("ApiKey: %v", apiKey))
-
-		if token == apiKey {
-			return apiKeyURL
+		// in constant time, so the digest can't be guessed byte by byte
+		if subtle.ConstantTimeCompare([]byte(fmt.Sprintf("%x", sum)), []byte(apiKey)) == 1 {
+			return apiKeyURL, ""
 		}
-		return ""
+		return "", "invalid_token"
 
 	} else {
-		return xApiKey
+		return xApiKey, ""
 	}
 
 }
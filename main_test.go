@@ -592,6 +592,34 @@ func TestRedirectGetWithoutApiKey(t *testing.T) {
 
 }
 
+func TestRedirectForwardsUpstreamKeyForToken(t *testing.T) {
+
+	var forwarded string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("X-Api-Key")
+	}))
+	defer ts.Close()
+
+	t.Setenv("REDIRECT_URL", ts.URL)
+	t.Setenv("X_API_KEY", "api-key")
+	t.Setenv("TOKEN", "token")
+
+	// clients present the md5 digest of TOKEN, never TOKEN itself
+	for apiKey, want := range map[string]string{
+		"94a08da1fecbb6e8b46990538c7b50b2": "api-key",
+		"token":                            "",
+		"wrong":                            "",
+	} {
+		forwarded = "unset"
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(redirect).ServeHTTP(rr, httptest.NewRequest("GET", "/redirect?api-key="+apiKey, nil))
+		if forwarded != want {
+			t.Errorf("api-key %s: got x-api-key %q forwarded want %q", apiKey, forwarded, want)
+		}
+	}
+
+}
+
 func TestRedirectGetWithoutAndInvalidApiKey(t *testing.T) {
 
 	// Create a test server that returns a predefined response
@@ -629,3 +657,136 @@ func TestRedirectGetWithoutAndInvalidApiKey(t *testing.T) {
 	}
 
 }
+
+func TestRedirectPostWithBodyTooLarge(t *testing.T) {
+
+	// Create a test server that records whether it was called
+	proxied := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = true
+		_, err := w.Write([]byte("OK"))
+		if err != nil {
+			return
+		}
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activeConfig.Store(&proxyConfig{MaxBodyBytes: 8})
+	defer activeConfig.Store(nil)
+
+	// Create a request whose length is only known once the body is read
+	body := []byte(`{"invoice":"123456"}`)
+	req := httptest.NewRequest("POST", "/redirect", &LimitedReader{R: bytes.NewReader(body), N: int64(len(body)) + 1})
+
+	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(redirect)
+
+	// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
+	// directly and pass in our Request and ResponseRecorder.
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusRequestEntityTooLarge)
+	}
+
+	if strings.TrimSpace(rr.Body.String()) != "Request body too large" {
+		t.Errorf("handler returned unexpected error message: got (%v) want (%v)",
+			rr.Body.String(), "Request body too large")
+	}
+
+	if proxied {
+		t.Errorf("request was forwarded upstream")
+	}
+
+}
+
+func TestRedirectPutWithContentLengthTooLarge(t *testing.T) {
+
+	// Create a test server that records whether it was called
+	proxied := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = true
+		_, err := w.Write([]byte("OK"))
+		if err != nil {
+			return
+		}
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activeConfig.Store(&proxyConfig{MaxBodyBytes: 8})
+	defer activeConfig.Store(nil)
+
+	// Create a request with a Content-Length over the limit
+	req := httptest.NewRequest("PUT", "/redirect", bytes.NewBuffer([]byte(`{"invoice":"123456"}`)))
+
+	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(redirect)
+
+	// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
+	// directly and pass in our Request and ResponseRecorder.
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusRequestEntityTooLarge)
+	}
+
+	if proxied {
+		t.Errorf("request was forwarded upstream")
+	}
+
+}
+
+func TestRedirectPostWithRouteBodyLimit(t *testing.T) {
+
+	// Create a test server that returns a predefined response
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte("OK"))
+		if err != nil {
+			return
+		}
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activeConfig.Store(&proxyConfig{
+		MaxBodyBytes: 8,
+		Routes:       []*route{{Name: "invoices", Path: "/invoices", MaxBodyBytes: 64}},
+	})
+	defer activeConfig.Store(nil)
+
+	// the route limit allows a body the global limit refuses
+	body := []byte(`{"invoice":"123456"}`)
+	for path, want := range map[string]int{
+		"/invoices/1": http.StatusOK,
+		"/wallets/1":  http.StatusRequestEntityTooLarge,
+	} {
+		req := httptest.NewRequest("POST", path, &LimitedReader{R: bytes.NewReader(body), N: int64(len(body)) + 1})
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(redirect).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", path, status, want)
+		}
+	}
+
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsPath is where the admin listener serves the Prometheus metrics.
+const metricsPath = "/metrics"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redirect_requests_total",
+		Help: "Requests handled by the proxy by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "redirect_request_duration_seconds",
+		Help:    "Time taken to answer requests by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	requestBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redirect_request_bytes_total",
+		Help: "Request body bytes received from clients by route and method.",
+	}, []string{"route", "method"})
+
+	responseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redirect_response_bytes_total",
+		Help: "Response body bytes sent to clients by route and method.",
+	}, []string{"route", "method"})
+
+	upstreamResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redirect_upstream_responses_total",
+		Help: "Upstream responses by route, method and status code, code is error when no response was received.",
+	}, []string{"route", "method", "code"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "redirect_upstream_duration_seconds",
+		Help:    "Time taken by the upstream to send the response headers by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redirect_auth_failures_total",
+		Help: "Refused credentials by route, method and reason.",
+	}, []string{"route", "method", "reason"})
+
+	validationRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redirect_validation_rejections_total",
+		Help: "Requests refused by a validator by route, method and validator.",
+	}, []string{"route", "method", "validator"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redirect_rate_limited_total",
+		Help: "Requests refused by a rate limit by route and method.",
+	}, []string{"route", "method"})
+
+	auditFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "redirect_audit_failures_total",
+		Help: "Audit log entries that could not be written to the audit sink.",
+	})
+
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redirect_config_reloads_total",
+		Help: "Configuration reloads by result, success or failure.",
+	}, []string{"result"})
+
+	configLastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "redirect_config_last_reload_successful",
+		Help: "Whether the last configuration reload succeeded.",
+	})
+
+	configLastReloadSuccessTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "redirect_config_last_reload_success_timestamp_seconds",
+		Help: "Time of the last successful configuration reload.",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		requestBytes,
+		responseBytes,
+		upstreamResponses,
+		upstreamDuration,
+		authFailures,
+		validationRejections,
+		rateLimited,
+		auditFailures,
+		configReloads,
+		configLastReloadSuccess,
+		configLastReloadSuccessTime,
+		stateCollector{},
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+// methodLabel keeps the method label bounded to the methods the proxy knows.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodOptions, http.MethodHead:
+		return method
+	}
+	return "OTHER"
+}
+
+// rejected counts a request refused by the named validator.
+func rejected(r *route, request *http.Request, validator string) {
+	validationRejections.WithLabelValues(r.Name, methodLabel(request.Method), validator).Inc()
+}
+
+// instrument counts the requests handled by next, their duration and the
+// bytes they carry, labelled with the route they match.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		labels := prometheus.Labels{
+			"route":  proxyConfigFrom(request.Context()).match(request).Name,
+			"method": methodLabel(request.Method),
+		}
+
+		body := &countingReader{ReadCloser: request.Body}
+		request.Body = body
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, request)
+
+		requestDuration.With(labels).Observe(time.Since(start).Seconds())
+		requestBytes.With(labels).Add(float64(body.n))
+		responseBytes.With(labels).Add(float64(recorder.written))
+		requestsTotal.WithLabelValues(labels["route"], labels["method"], strconv.Itoa(recorder.status)).Inc()
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// statusRecorder remembers the status code and the size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+var (
+	upstreamHealthyDesc = prometheus.NewDesc("redirect_upstream_healthy",
+		"Whether the upstream target passes its health checks.", []string{"target"}, nil)
+	concurrencyInFlightDesc = prometheus.NewDesc("redirect_concurrency_in_flight",
+		"Requests of the route in flight to the upstream.", []string{"route"}, nil)
+	concurrencyQueuedDesc = prometheus.NewDesc("redirect_concurrency_queued",
+		"Requests of the route waiting for an upstream slot.", []string{"route"}, nil)
+	concurrencyRejectedDesc = prometheus.NewDesc("redirect_concurrency_rejected_total",
+		"Requests of the route refused because the wait queue was full or timed out.", []string{"route"}, nil)
+)
+
+// stateCollector exports the state kept by the health checker and the
+// concurrency limiters when metrics are scraped.
+type stateCollector struct{}
+
+func (stateCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- upstreamHealthyDesc
+	descs <- concurrencyInFlightDesc
+	descs <- concurrencyQueuedDesc
+	descs <- concurrencyRejectedDesc
+}
+
+func (stateCollector) Collect(metrics chan<- prometheus.Metric) {
+	for _, status := range checker.statuses() {
+		healthy := 0.0
+		if status.Healthy {
+			healthy = 1
+		}
+		metrics <- prometheus.MustNewConstMetric(upstreamHealthyDesc, prometheus.GaugeValue, healthy, status.URL)
+	}
+	for name, stats := range limiters.stats() {
+		metrics <- prometheus.MustNewConstMetric(concurrencyInFlightDesc, prometheus.GaugeValue, float64(stats.InFlight), name)
+		metrics <- prometheus.MustNewConstMetric(concurrencyQueuedDesc, prometheus.GaugeValue, float64(stats.Queued), name)
+		metrics <- prometheus.MustNewConstMetric(concurrencyRejectedDesc, prometheus.CounterValue, float64(stats.Rejected), name)
+	}
+}
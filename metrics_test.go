@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRequests(t *testing.T) {
+
+	// Create a test server that returns a predefined response
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activeConfig.Store(&proxyConfig{
+		MaxBodyBytes: defaultMaxBodyBytes,
+		Routes:       []*route{{Name: "metrics-invoices", Path: "/invoices"}},
+	})
+	defer activeConfig.Store(nil)
+
+	// the counters are global, so what the request adds is checked
+	counters := map[string]struct {
+		counter prometheus.Collector
+		want    float64
+	}{
+		"requests":           {requestsTotal.WithLabelValues("metrics-invoices", "POST", "201"), 1},
+		"upstream responses": {upstreamResponses.WithLabelValues("metrics-invoices", "POST", "201"), 1},
+		"request bytes":      {requestBytes.WithLabelValues("metrics-invoices", "POST"), 20},
+		"response bytes":     {responseBytes.WithLabelValues("metrics-invoices", "POST"), 7},
+	}
+	before := map[string]float64{}
+	for name, c := range counters {
+		before[name] = testutil.ToFloat64(c.counter)
+	}
+
+	req := httptest.NewRequest("POST", "/invoices", bytes.NewBuffer([]byte(`{"invoice":"123456"}`)))
+	rr := httptest.NewRecorder()
+	newMux().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	for name, c := range counters {
+		if got := testutil.ToFloat64(c.counter) - before[name]; got != c.want {
+			t.Errorf("%s: got %v want %v", name, got, c.want)
+		}
+	}
+
+	if n := testutil.CollectAndCount(requestDuration, "redirect_request_duration_seconds"); n == 0 {
+		t.Errorf("request duration not observed")
+	}
+
+}
+
+func TestMetricsRejections(t *testing.T) {
+
+	// Create a test server that returns a predefined response
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Setenv("TOKEN", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activeConfig.Store(&proxyConfig{
+		MaxBodyBytes: defaultMaxBodyBytes,
+		Routes:       []*route{{Name: "metrics-rejections", Path: "/rejections"}},
+	})
+	defer activeConfig.Store(nil)
+
+	before := testutil.ToFloat64(validationRejections.WithLabelValues("metrics-rejections", "GET", "validateQueryParameters"))
+	http.HandlerFunc(redirect).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/rejections?key()=1", nil))
+	if got := testutil.ToFloat64(validationRejections.WithLabelValues("metrics-rejections", "GET", "validateQueryParameters")); got != before+1 {
+		t.Errorf("query rejection not counted: got %v want %v", got, before+1)
+	}
+
+	before = testutil.ToFloat64(authFailures.WithLabelValues("metrics-rejections", "GET", "invalid_token"))
+	http.HandlerFunc(redirect).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/rejections?api-key=wrong", nil))
+	if got := testutil.ToFloat64(authFailures.WithLabelValues("metrics-rejections", "GET", "invalid_token")); got != before+1 {
+		t.Errorf("auth failure not counted: got %v want %v", got, before+1)
+	}
+
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+
+	limiters.get("metrics-endpoint", concurrencyLimit{MaxInFlight: 1})
+
+	req := httptest.NewRequest("GET", metricsPath, nil)
+	rr := httptest.NewRecorder()
+	newAdminMux(runtimeSettings{}).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	for _, name := range []string{
+		"go_goroutines",
+		`redirect_concurrency_in_flight{route="metrics-endpoint"} 0`,
+		`redirect_concurrency_rejected_total{route="metrics-endpoint"} 0`,
+	} {
+		if !strings.Contains(rr.Body.String(), name) {
+			t.Errorf("metric %s not exported", name)
+		}
+	}
+
+}
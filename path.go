@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// percentEncoded matches a percent-encoded byte left in a path segment
+// once decoded, the mark of double encoding.
+var percentEncoded = regexp.MustCompile(`%[0-9a-fA-F]{2}`)
+
+// normalizePath returns the canonical escaped form of an escaped request
+// path: empty segments collapsed and every segment escaped the same way.
+// Dot segments, encoded separators, control characters and double
+// encoding are refused rather than cleaned, since the upstream might
+// resolve them differently.
+func normalizePath(escaped string) (string, error) {
+	if !strings.HasPrefix(escaped, "/") {
+		return "", errors.New("path must start with /")
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(escaped[1:], "/") {
+		if segment == "" {
+			continue
+		}
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", fmt.Errorf("invalid path encoding: %q", segment)
+		}
+		if decoded == "." || decoded == ".." {
+			return "", errors.New("path traversal")
+		}
+		if strings.ContainsAny(decoded, `/\`) {
+			return "", errors.New("encoded path separator")
+		}
+		if percentEncoded.MatchString(decoded) {
+			return "", errors.New("double encoded path")
+		}
+		for i := 0; i < len(decoded); i++ {
+			if decoded[i] < ' ' || decoded[i] == 0x7f {
+				return "", errors.New("control character in path")
+			}
+		}
+		segments = append(segments, url.PathEscape(decoded))
+	}
+
+	path := "/" + strings.Join(segments, "/")
+	if len(segments) > 0 && strings.HasSuffix(escaped, "/") {
+		path += "/"
+	}
+	return path, nil
+}
+
+// pathErrorKey is the context key of the error found in the path of a
+// request by normalizePaths.
+type pathErrorKey struct{}
+
+// normalizePaths replaces the path of every request with its normalized
+// form before next routes it, so every middleware sees the route the
+// request is forwarded to. Invalid paths are left as they are and their
+// error is kept in the context for redirect to refuse them, so they are
+// still logged, traced and counted.
+func normalizePaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		path, err := normalizePath(request.URL.EscapedPath())
+		if err != nil {
+			next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), pathErrorKey{}, err)))
+			return
+		}
+		normalized := *request.URL
+		normalized.Path, _ = url.PathUnescape(path)
+		normalized.RawPath = path
+		request.URL = &normalized
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// pathError returns the error normalizePaths found in the path of the
+// request, nil when it is valid.
+func pathError(ctx context.Context) error {
+	err, _ := ctx.Value(pathErrorKey{}).(error)
+	return err
+}
+
+// parseUpstream parses an upstream URL, which must be absolute and must not
+// carry credentials, a query or a fragment.
+func parseUpstream(upstream string) (*url.URL, error) {
+	base, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %v", err)
+	}
+	if !base.IsAbs() || base.Host == "" {
+		return nil, fmt.Errorf("url must be absolute")
+	}
+	if base.RawQuery != "" || base.ForceQuery || base.Fragment != "" || base.User != nil {
+		return nil, fmt.Errorf("upstream url must not carry credentials, a query or a fragment")
+	}
+	return base, nil
+}
+
+// joinUpstream appends a path normalized by normalizePath to the path of
+// the upstream URL, and makes sure the result is still on the upstream
+// origin and under its path.
+func joinUpstream(upstream, path string) (*url.URL, error) {
+	base, err := parseUpstream(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if normalized, err := normalizePath(path); err != nil || normalized != path {
+		return nil, fmt.Errorf("path %s is not normalized", path)
+	}
+
+	prefix := strings.TrimSuffix(base.EscapedPath(), "/")
+	target, err := url.Parse(base.Scheme + "://" + base.Host + prefix + path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %v", err)
+	}
+	if target.Scheme != base.Scheme || target.Host != base.Host || target.User != nil ||
+		!pathHasPrefix(target.EscapedPath(), prefix+"/") {
+		return nil, fmt.Errorf("url leaves the upstream")
+	}
+	return target, nil
+}
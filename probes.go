@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Paths served by the service itself, they are never forwarded upstream.
+const (
+	livenessPath  = "/healthz"
+	readinessPath = "/readyz"
+)
+
+// healthz reports that the process is alive and serving requests.
+func healthz(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = writer.Write([]byte("ok\n"))
+}
+
+// readyz reports whether the service can forward requests: the
+// configuration is valid and the upstream is passing its health checks.
+func readyz(writer http.ResponseWriter, request *http.Request) {
+	if err := ready(); err != nil {
+		http.Error(writer, fmt.Sprintf("Not ready: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = writer.Write([]byte("ok\n"))
+}
+
+func ready() error {
+	if draining.Load() {
+		return fmt.Errorf("shutting down")
+	}
+	redirectURL := currentProxyConfig().redirectURL()
+	if redirectURL == "" {
+		return fmt.Errorf("REDIRECT_URL environment variable not set")
+	}
+	if _, err := parseUpstream(redirectURL); err != nil {
+		return err
+	}
+	if !checker.healthy(redirectURL) {
+		return fmt.Errorf("upstream is unhealthy")
+	}
+	return nil
+}
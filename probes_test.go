@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbesAreNotForwarded(t *testing.T) {
+
+	// Create a test server that records whether it was called
+	var proxied atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(true)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{livenessPath, readinessPath} {
+		req := httptest.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+		newMux().ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("%s returned wrong status code: got %v want %v",
+				path, status, http.StatusOK)
+		}
+	}
+
+	if proxied.Load() {
+		t.Errorf("probe request was forwarded upstream")
+	}
+
+}
+
+func TestReadyzWithoutRedirectURL(t *testing.T) {
+
+	err := os.Setenv("REDIRECT_URL", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", readinessPath, nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(readyz).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusServiceUnavailable)
+	}
+
+	// the process is still alive
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(healthz).ServeHTTP(rr, httptest.NewRequest("GET", livenessPath, nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+}
+
+func TestReadyzWithInvalidRedirectURL(t *testing.T) {
+
+	// no request could be forwarded to an upstream carrying a query
+	t.Setenv("REDIRECT_URL", "http://wallet.example.com?tenant=1")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(readyz).ServeHTTP(rr, httptest.NewRequest("GET", readinessPath, nil))
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusServiceUnavailable)
+	}
+
+}
+
+func TestReadyzWithUnhealthyUpstream(t *testing.T) {
+
+	// Create a test server that always fails its health check
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checker = newHealthChecker(healthCheckConfig{
+		Path:               "/health",
+		ExpectedStatus:     http.StatusOK,
+		Interval:           time.Hour,
+		Timeout:            time.Second,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	}, ts.URL)
+	defer func() { checker = nil }()
+	checker.probeAll()
+
+	req := httptest.NewRequest("GET", readinessPath, nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(readyz).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusServiceUnavailable)
+	}
+
+}
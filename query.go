@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// querySchema declares the query parameters a route accepts.
+type querySchema struct {
+	// Parameters holds the declared parameters by name.
+	Parameters map[string]*queryParameter `json:"parameters"`
+	// AllowUnknown accepts parameters the schema doesn't declare, as long
+	// as their name is made of the usual characters.
+	AllowUnknown bool `json:"allow_unknown,omitempty"`
+}
+
+// queryParameter constrains the values of a query parameter.
+type queryParameter struct {
+	// Type is string, int, enum, bitcoin_address, uuid, date (YYYY-MM-DD)
+	// or datetime (RFC 3339). Defaults to string.
+	Type     string `json:"type,omitempty"`
+	Required bool   `json:"required,omitempty"`
+	// Multiple accepts the parameter more than once.
+	Multiple bool `json:"multiple,omitempty"`
+	// MaxLength bounds the length of every value, 256 by default.
+	MaxLength int `json:"max_length,omitempty"`
+	// Pattern is a regular expression string values must match.
+	Pattern string `json:"pattern,omitempty"`
+	// Min and Max bound int values.
+	Min *int64 `json:"min,omitempty"`
+	Max *int64 `json:"max,omitempty"`
+	// Values lists the accepted values of an enum.
+	Values []string `json:"values,omitempty"`
+	// Network restricts bitcoin addresses to mainnet, testnet or regtest.
+	Network string `json:"network,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// defaultMaxQueryValueLength bounds query values when the schema doesn't
+// say otherwise.
+const defaultMaxQueryValueLength = 256
+
+// consumedQueryParameters are read by the proxy itself and don't need to
+// be declared.
+var consumedQueryParameters = []string{"api-key"}
+
+func (s *querySchema) validate() error {
+	if s == nil {
+		return nil
+	}
+	for name, p := range s.Parameters {
+		if p == nil {
+			return fmt.Errorf("query parameter %s: empty declaration", name)
+		}
+		switch p.Type {
+		case "", "string", "int", "bitcoin_address", "uuid", "date", "datetime":
+		case "enum":
+			if len(p.Values) == 0 {
+				return fmt.Errorf("query parameter %s: enum without values", name)
+			}
+		default:
+			return fmt.Errorf("query parameter %s: unknown type %q", name, p.Type)
+		}
+		switch p.Network {
+		case "", "mainnet", "testnet", "regtest":
+		default:
+			return fmt.Errorf("query parameter %s: network must be mainnet, testnet or regtest", name)
+		}
+		if p.MaxLength < 0 {
+			return fmt.Errorf("query parameter %s: max_length must not be negative", name)
+		}
+		if p.Pattern != "" {
+			compiled, err := regexp.Compile("^(?:" + p.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("query parameter %s: %v", name, err)
+			}
+			p.pattern = compiled
+		}
+	}
+	return nil
+}
+
+// check returns every violation of the schema found in the query, sorted
+// by parameter.
+func (s *querySchema) check(query url.Values) []violation {
+	var violations []violation
+	add := func(name string, format string, args ...any) {
+		violations = append(violations, violation{Field: name, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for name, values := range query {
+		p, ok := s.Parameters[name]
+		if !ok {
+			if contains(consumedQueryParameters, name) {
+				continue
+			}
+			if !s.AllowUnknown {
+				add(name, "unknown parameter")
+			} else if !queryKeyPattern.MatchString(name) {
+				add(name, "invalid parameter name")
+			}
+			continue
+		}
+		if len(values) > 1 && !p.Multiple {
+			add(name, "must not be repeated")
+		}
+		for _, value := range values {
+			if err := p.check(value); err != nil {
+				add(name, "%v", err)
+			}
+		}
+	}
+	for name, p := range s.Parameters {
+		if _, ok := query[name]; p.Required && !ok {
+			add(name, "required")
+		}
+	}
+
+	sort.SliceStable(violations, func(i, j int) bool { return violations[i].Field < violations[j].Field })
+	return violations
+}
+
+func (p *queryParameter) check(value string) error {
+	limit := p.MaxLength
+	if limit == 0 {
+		limit = defaultMaxQueryValueLength
+	}
+	if len(value) > limit {
+		return fmt.Errorf("longer than %d characters", limit)
+	}
+
+	switch p.Type {
+	case "int":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		if p.Min != nil && n < *p.Min {
+			return fmt.Errorf("must be at least %d", *p.Min)
+		}
+		if p.Max != nil && n > *p.Max {
+			return fmt.Errorf("must be at most %d", *p.Max)
+		}
+	case "enum":
+		if !contains(p.Values, value) {
+			return fmt.Errorf("must be one of %s", strings.Join(p.Values, ", "))
+		}
+	case "bitcoin_address":
+		network, err := bitcoinAddressNetwork(value)
+		if err != nil {
+			return fmt.Errorf("must be a bitcoin address: %v", err)
+		}
+		if p.Network != "" && network != p.Network {
+			return fmt.Errorf("must be a %s address", p.Network)
+		}
+	case "uuid":
+		// only the canonical 8-4-4-4-12 form
+		if _, err := uuid.Parse(value); err != nil || len(value) != 36 {
+			return fmt.Errorf("must be a UUID")
+		}
+	case "date":
+		if _, err := time.Parse(time.DateOnly, value); err != nil {
+			return fmt.Errorf("must be a date such as 2024-01-31")
+		}
+	case "datetime":
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return fmt.Errorf("must be a date and time such as 2024-01-31T12:00:00Z")
+		}
+	}
+
+	if p.pattern != nil && !p.pattern.MatchString(value) {
+		return fmt.Errorf("must match %s", p.Pattern)
+	}
+	return nil
+}
+
+// forwardQuery returns how the query of the route is forwarded: encoded,
+// the default, or raw.
+func (c *proxyConfig) forwardQuery(r *route) string {
+	if r.ForwardQuery != "" {
+		return r.ForwardQuery
+	}
+	if c.ForwardQuery != "" {
+		return c.ForwardQuery
+	}
+	return "encoded"
+}
+
+func validateForwardQuery(mode string) error {
+	if mode != "" && mode != "encoded" && mode != "raw" {
+		return fmt.Errorf("forward_query must be encoded or raw")
+	}
+	return nil
+}
+
+// upstreamQuery returns the query to forward. The encoded mode sorts the
+// parameters and encodes them again, the raw mode keeps the query of the
+// request byte for byte without the parameters consumed by the proxy, for
+// upstreams verifying a signature of it.
+func upstreamQuery(mode string, rawQuery string, query url.Values) string {
+	if mode != "raw" {
+		return query.Encode()
+	}
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		name, _, _ := strings.Cut(part, "=")
+		if name, err := url.QueryUnescape(name); err == nil && contains(consumedQueryParameters, name) {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, "&")
+}
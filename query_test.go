@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestQuerySchemaCheck(t *testing.T) {
+
+	minimum, maximum := int64(1), int64(100)
+	schema := &querySchema{Parameters: map[string]*queryParameter{
+		"limit":   {Type: "int", Min: &minimum, Max: &maximum},
+		"status":  {Type: "enum", Values: []string{"pending", "confirmed"}},
+		"address": {Type: "bitcoin_address", Network: "mainnet", Required: true},
+		"wallet":  {Type: "uuid"},
+		"from":    {Type: "date"},
+		"since":   {Type: "datetime"},
+		"label":   {MaxLength: 8, Pattern: "[a-z]+"},
+		"tag":     {Multiple: true},
+	}}
+	if err := schema.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := url.Values{
+		"address": {"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"},
+		"limit":   {"10"},
+		"status":  {"pending"},
+		"wallet":  {"0190a0f3-7e6b-7c3a-9f1e-2b3c4d5e6f70"},
+		"from":    {"2024-02-29"},
+		"since":   {"2024-02-29T12:00:00Z"},
+		"label":   {"savings"},
+		"tag":     {"a", "b"},
+		"api-key": {"94a08da1fecbb6e8b46990538c7b50b2"},
+	}
+	if violations := schema.check(valid); len(violations) != 0 {
+		t.Errorf("valid query refused: %v", violations)
+	}
+
+	invalid := url.Values{
+		"limit":  {"1000"},
+		"status": {"lost"},
+		"wallet": {"0190a0f37e6b7c3a9f1e2b3c4d5e6f70"},
+		"from":   {"2023-02-29"},
+		"label":  {"SAVINGS", "b"},
+		"debug":  {"1"},
+	}
+	var fields []string
+	for _, v := range schema.check(invalid) {
+		fields = append(fields, v.Field)
+	}
+	want := []string{"address", "debug", "from", "label", "label", "limit", "status", "wallet"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("got violations of %v want %v", fields, want)
+	}
+
+	// testnet addresses are refused when the parameter is for mainnet
+	if violations := schema.check(url.Values{"address": {"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7"}}); len(violations) != 1 {
+		t.Errorf("got violations %v want the network", violations)
+	}
+
+}
+
+func TestQuerySchemaValidate(t *testing.T) {
+
+	for name, schema := range map[string]*querySchema{
+		"type":    {Parameters: map[string]*queryParameter{"a": {Type: "float"}}},
+		"enum":    {Parameters: map[string]*queryParameter{"a": {Type: "enum"}}},
+		"network": {Parameters: map[string]*queryParameter{"a": {Type: "bitcoin_address", Network: "signet"}}},
+		"pattern": {Parameters: map[string]*queryParameter{"a": {Pattern: "("}}},
+	} {
+		if err := schema.validate(); err == nil {
+			t.Errorf("%s: invalid schema accepted", name)
+		}
+	}
+
+}
+
+func TestRedirectQuerySchema(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	t.Setenv("REDIRECT_URL", ts.URL)
+	activeConfig.Store(mustProxyConfig(t, `{
+		"routes": [{
+			"name": "transactions",
+			"path": "/transactions",
+			"query": {"parameters": {
+				"limit": {"type": "int"},
+				"address": {"type": "bitcoin_address", "required": true}
+			}}
+		}]
+	}`))
+	defer activeConfig.Store(nil)
+
+	req := httptest.NewRequest("GET", "/transactions?limit=ten&filter=%27%20OR%201=1", nil)
+	req.Header.Set(requestIDHeader, "query-schema")
+	rr := httptest.NewRecorder()
+	newMux().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	var body struct {
+		Error      string      `json:"error"`
+		RequestID  string      `json:"request_id"`
+		Violations []violation `json:"violations"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response is not JSON: %q", rr.Body.String())
+	}
+	want := []violation{
+		{Field: "address", Message: "required"},
+		{Field: "filter", Message: "unknown parameter"},
+		{Field: "limit", Message: "must be an integer"},
+	}
+	if !reflect.DeepEqual(body.Violations, want) || body.RequestID != "query-schema" {
+		t.Errorf("unexpected response: %+v", body)
+	}
+
+	req = httptest.NewRequest("GET", "/transactions?address=3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy&limit=5", nil)
+	rr = httptest.NewRecorder()
+	newMux().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+}
+
+func TestUpstreamQuery(t *testing.T) {
+
+	for _, tc := range []struct {
+		mode string
+		raw  string
+		want string
+	}{
+		{"encoded", "b=2&a=1&a=0", "a=1&a=0&b=2"},
+		{"encoded", "", ""},
+		{"raw", "b=2&a=%7e1+2&a=0", "b=2&a=%7e1+2&a=0"},
+		{"raw", "sig=x&api-key=secret&b=%2F", "sig=x&b=%2F"},
+		{"raw", "api%2Dkey=secret&api-keys=1", "api-keys=1"},
+		{"raw", "api-key=secret", ""},
+		{"raw", "", ""},
+	} {
+		query, _ := url.ParseQuery(tc.raw)
+		if got := upstreamQuery(tc.mode, tc.raw, query); got != tc.want {
+			t.Errorf("%s %q: got %q want %q", tc.mode, tc.raw, got, tc.want)
+		}
+	}
+
+}
+
+func TestRedirectForwardQuery(t *testing.T) {
+
+	var requestURI string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURI = r.RequestURI
+	}))
+	defer ts.Close()
+
+	t.Setenv("REDIRECT_URL", ts.URL)
+	activeConfig.Store(mustProxyConfig(t, `{
+		"routes": [{"name": "signed", "path": "/signed", "forward_query": "raw"}]
+	}`))
+	defer activeConfig.Store(nil)
+
+	for path, want := range map[string]string{
+		"/signed?b=2&a=%7E1&api-key=secret&sig=abc%3D": "/signed?b=2&a=%7E1&sig=abc%3D",
+		"/signed?api-key=secret":                       "/signed",
+		"/signed":                                      "/signed",
+		"/wallets?b=2&a=1":                             "/wallets?a=1&b=2",
+		"/wallets":                                     "/wallets",
+		"/wallets?a=1&x;a=2":                           "/wallets?a=1",
+	} {
+		requestURI = ""
+		rr := httptest.NewRecorder()
+		newMux().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusOK || requestURI != want {
+			t.Errorf("%s: got status %v forwarded as %q want %q", path, rr.Code, requestURI, want)
+		}
+	}
+
+	// raw queries the proxy can't fully parse aren't forwarded
+	for _, path := range []string{"/signed?amount=5&x;amount=99999", "/signed?amount=5&%zz=1&amount=%41%zz"} {
+		requestURI = ""
+		rr := httptest.NewRecorder()
+		newMux().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusBadRequest || requestURI != "" {
+			t.Errorf("%s: got status %v forwarded as %q want %v", path, rr.Code, requestURI, http.StatusBadRequest)
+		}
+	}
+
+}
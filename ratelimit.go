@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimit is a token bucket refilled with Rate tokens per second and
+// holding at most Burst tokens.
+type rateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// rateLimits are the buckets a request takes a token from: one per client
+// identity, one per client IP and one shared by every request of the route.
+type rateLimits struct {
+	Client *rateLimit `json:"client,omitempty"`
+	IP     *rateLimit `json:"ip,omitempty"`
+	Route  *rateLimit `json:"route,omitempty"`
+}
+
+// rateDecision is the outcome of taking a token from a bucket.
+type rateDecision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is the time until a token is available again.
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+}
+
+// rateLimitStore keeps the state of the token buckets. The in-memory store
+// limits a single instance, a store shared between instances can be
+// plugged in by implementing this interface.
+type rateLimitStore interface {
+	take(key string, limit rateLimit, now time.Time) (rateDecision, error)
+}
+
+// rateLimiter is the store used by the proxy.
+var rateLimiter rateLimitStore = newMemoryRateLimitStore()
+
+type bucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*bucket{}}
+}
+
+func (s *memoryRateLimitStore) take(key string, limit rateLimit, now time.Time) (rateDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// forget buckets that have refilled completely once a minute
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if refill(b, now) >= float64(b.limit.Burst) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+	b.limit = limit
+	b.tokens = refill(b, now)
+	b.last = now
+
+	decision := rateDecision{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = secondsToDuration((1 - b.tokens) / limit.Rate)
+	}
+	decision.Remaining = int(b.tokens)
+	decision.Reset = secondsToDuration((float64(limit.Burst) - b.tokens) / limit.Rate)
+	return decision, nil
+}
+
+func refill(b *bucket, now time.Time) float64 {
+	return math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func (l *rateLimit) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.Rate <= 0 || l.Burst < 1 {
+		return fmt.Errorf("rate must be positive and burst at least 1")
+	}
+	return nil
+}
+
+func (l *rateLimits) validate() error {
+	if l == nil {
+		return nil
+	}
+	for name, limit := range map[string]*rateLimit{"client": l.Client, "ip": l.IP, "route": l.Route} {
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("%s rate limit: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// rateLimits returns the limits of the route, falling back to the global
+// limits for the buckets the route doesn't configure.
+func (c *proxyConfig) rateLimits(r *route) rateLimits {
+	var limits rateLimits
+	if c.RateLimits != nil {
+		limits = *c.RateLimits
+	}
+	if r.RateLimits != nil {
+		if r.RateLimits.Client != nil {
+			limits.Client = r.RateLimits.Client
+		}
+		if r.RateLimits.IP != nil {
+			limits.IP = r.RateLimits.IP
+		}
+		if r.RateLimits.Route != nil {
+			limits.Route = r.RateLimits.Route
+		}
+	}
+	return limits
+}
+
+// allowRequest takes a token from every bucket the request is limited by
+// and sets the RateLimit headers of the most restrictive one. It answers
+// the request with 429 and returns false when a bucket is empty.
+func allowRequest(writer http.ResponseWriter, request *http.Request, proxy *proxyConfig, r *route) bool {
+	limits := proxy.rateLimits(r)
+
+	var keys []string
+	var buckets []rateLimit
+	// anonymous callers are only limited by their IP, and so are callers
+	// whose api-key is refused, or rotating invalid keys would get them a
+	// full bucket every time
+	c := identify(request)
+	if c.Name == "token" {
+		if _, reason := validateApiKey(proxy, request.URL.Query().Get("api-key"), ""); reason != "" {
+			c.ID = ""
+		}
+	}
+	if limits.Client != nil && c.ID != "" {
+		keys = append(keys, "client:"+r.Name+":"+c.ID)
+		buckets = append(buckets, *limits.Client)
+	}
+	if limits.IP != nil {
+		keys = append(keys, "ip:"+r.Name+":"+proxy.clientIP(request))
+		buckets = append(buckets, *limits.IP)
+	}
+	if limits.Route != nil {
+		keys = append(keys, "route:"+r.Name)
+		buckets = append(buckets, *limits.Route)
+	}
+	if len(keys) == 0 {
+		return true
+	}
+
+	now := time.Now()
+	var strictest *rateDecision
+	for i, key := range keys {
+		decision, err := rateLimiter.take(key, buckets[i], now)
+		if err != nil {
+			// an unavailable store must not take the proxy down with it
+			continue
+		}
+		if strictest == nil || !decision.Allowed && strictest.Allowed ||
+			decision.Allowed == strictest.Allowed && decision.Remaining < strictest.Remaining {
+			strictest = &decision
+		}
+	}
+	if strictest == nil {
+		return true
+	}
+
+	writer.Header().Set("RateLimit-Limit", strconv.Itoa(strictest.Limit))
+	writer.Header().Set("RateLimit-Remaining", strconv.Itoa(strictest.Remaining))
+	writer.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(strictest.Reset)))
+
+	if !strictest.Allowed {
+		writer.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(strictest.RetryAfter)))
+		httpError(writer, request, "Too many requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+
+	store := newMemoryRateLimitStore()
+	limit := rateLimit{Rate: 1, Burst: 2}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		decision, _ := store.take("key", limit, now)
+		if !decision.Allowed {
+			t.Fatalf("request %d refused within the burst", i)
+		}
+	}
+
+	decision, _ := store.take("key", limit, now)
+	if decision.Allowed || decision.Remaining != 0 {
+		t.Errorf("request allowed over the burst: %+v", decision)
+	}
+	if decision.RetryAfter <= 0 || decision.RetryAfter > time.Second {
+		t.Errorf("unexpected retry after: %v", decision.RetryAfter)
+	}
+
+	// other keys have their own bucket
+	if decision, _ := store.take("other", limit, now); !decision.Allowed {
+		t.Errorf("request refused on an unused bucket")
+	}
+
+	// a token is back after a second
+	if decision, _ := store.take("key", limit, now.Add(time.Second)); !decision.Allowed {
+		t.Errorf("request refused after the bucket refilled")
+	}
+
+}
+
+func TestRedirectRateLimitedClient(t *testing.T) {
+
+	// Create a test server that returns a predefined response
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte("OK"))
+		if err != nil {
+			return
+		}
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rateLimiter = newMemoryRateLimitStore()
+	activeConfig.Store(&proxyConfig{
+		MaxBodyBytes: defaultMaxBodyBytes,
+		RateLimits:   &rateLimits{Client: &rateLimit{Rate: 0.001, Burst: 1}},
+	})
+	defer activeConfig.Store(nil)
+
+	send := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/redirect", nil)
+		req.Header.Set("X-Api-Key", key)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(redirect).ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send("key-1"); rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("first request: got %v remaining %q", rr.Code, rr.Header().Get("RateLimit-Remaining"))
+	}
+
+	rr := send("key-1")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			rr.Code, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") == "" || rr.Header().Get("RateLimit-Limit") != "1" {
+		t.Errorf("missing rate limit headers: %v", rr.Header())
+	}
+
+	// another key is not affected
+	if rr := send("key-2"); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+}
+
+func TestRedirectRateLimitedInvalidApiKey(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	t.Setenv("REDIRECT_URL", ts.URL)
+	t.Setenv("TOKEN", "token")
+
+	rateLimiter = newMemoryRateLimitStore()
+	activeConfig.Store(&proxyConfig{
+		MaxBodyBytes: defaultMaxBodyBytes,
+		RateLimits:   &rateLimits{Client: &rateLimit{Rate: 0.001, Burst: 1}, IP: &rateLimit{Rate: 0.001, Burst: 3}},
+	})
+	defer activeConfig.Store(nil)
+
+	send := func(apiKey string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(redirect).ServeHTTP(rr, httptest.NewRequest("GET", "/redirect?api-key="+apiKey, nil))
+		return rr
+	}
+
+	// a valid key has its own bucket
+	if rr := send("94a08da1fecbb6e8b46990538c7b50b2"); rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "1" {
+		t.Errorf("valid key: got %v limit %q", rr.Code, rr.Header().Get("RateLimit-Limit"))
+	}
+
+	// refused keys share the bucket of the IP, whatever key they rotate to,
+	// which the valid key took a token from as well
+	for i, key := range []string{"random-1", "random-2", "random-3"} {
+		rr := send(key)
+		if rr.Header().Get("RateLimit-Limit") != "3" {
+			t.Errorf("%s: limited by a bucket of %q, not the IP", key, rr.Header().Get("RateLimit-Limit"))
+		}
+		if limited := rr.Code == http.StatusTooManyRequests; limited != (i == 2) {
+			t.Errorf("%s: got status %v", key, rr.Code)
+		}
+	}
+
+}
+
+func TestRedirectRateLimitedRoute(t *testing.T) {
+
+	// Create a test server that returns a predefined response
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte("OK"))
+		if err != nil {
+			return
+		}
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rateLimiter = newMemoryRateLimitStore()
+	activeConfig.Store(&proxyConfig{
+		MaxBodyBytes: defaultMaxBodyBytes,
+		RateLimits:   &rateLimits{IP: &rateLimit{Rate: 100, Burst: 100}},
+		Routes: []*route{{
+			Name:       "invoices",
+			Path:       "/invoices",
+			RateLimits: &rateLimits{IP: &rateLimit{Rate: 0.001, Burst: 1}},
+		}},
+	})
+	defer activeConfig.Store(nil)
+
+	send := func(path string) int {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(redirect).ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr.Code
+	}
+
+	if code := send("/invoices"); code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+	if code := send("/invoices"); code != http.StatusTooManyRequests {
+		t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusTooManyRequests)
+	}
+
+	// the global limit still applies to other routes
+	if code := send("/wallets"); code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+
+}
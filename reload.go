@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// configReloader loads the configuration again when asked to or when one
+// of the files it is read from changes. A configuration that fails to load
+// or validate is discarded and the active one is kept.
+type configReloader struct {
+	path string
+	// interval between checks of the files, zero disables watching.
+	interval time.Duration
+	// digest of the watched files when the configuration was last loaded.
+	digest [sha256.Size]byte
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newConfigReloader(path string, interval time.Duration) *configReloader {
+	r := &configReloader{
+		path:     path,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	r.digest = r.filesDigest()
+	configLastReloadSuccess.Set(1)
+	configLastReloadSuccessTime.SetToCurrentTime()
+	return r
+}
+
+// start reloads on every value received from hangups and, when watching is
+// enabled, whenever the watched files change, until close is called.
+func (r *configReloader) start(hangups <-chan os.Signal) {
+	go func() {
+		defer close(r.done)
+
+		var ticks <-chan time.Time
+		if r.interval > 0 {
+			ticker := time.NewTicker(r.interval)
+			defer ticker.Stop()
+			ticks = ticker.C
+		}
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-hangups:
+				slog.Info("Reloading configuration", "trigger", "signal")
+				_ = r.reload()
+			case <-ticks:
+				if r.filesDigest() != r.digest {
+					slog.Info("Reloading configuration", "trigger", "file_change")
+					_ = r.reload()
+				}
+			}
+		}
+	}()
+}
+
+func (r *configReloader) close() {
+	close(r.stop)
+	<-r.done
+}
+
+// reload loads and validates the configuration, then swaps it in at once.
+// Requests already in flight finish with the configuration they started
+// with.
+func (r *configReloader) reload() error {
+	// taken first so a change made while loading triggers another reload
+	digest := r.filesDigest()
+
+	config, err := loadProxyConfig(r.path)
+	if err != nil {
+		configReloads.WithLabelValues("failure").Inc()
+		configLastReloadSuccess.Set(0)
+		slog.Error("Configuration reload failed, keeping the active configuration", "error", err)
+		// the same files are not tried again until they change
+		r.digest = digest
+		return err
+	}
+
+	previous := currentProxyConfig()
+	activeConfig.Store(config)
+	checker.setTargets(config.redirectURL())
+	r.digest = digest
+
+	configReloads.WithLabelValues("success").Inc()
+	configLastReloadSuccess.Set(1)
+	configLastReloadSuccessTime.SetToCurrentTime()
+	slog.Info("Configuration reloaded",
+		"routes", len(config.Routes),
+		"upstream_changed", config.redirectURL() != previous.redirectURL(),
+	)
+	return nil
+}
+
+// watchedFiles are the config file, the files secrets are read from and
+// the schemas of the active configuration.
+func (r *configReloader) watchedFiles() []string {
+	files := append([]string{r.path}, currentProxyConfig().schemaFiles...)
+	for _, name := range secretFiles {
+		if file := os.Getenv(name + "_FILE"); file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// filesDigest hashes the content of the watched files. Contents are
+// compared rather than modification times so the atomic symlink swap of a
+// Kubernetes ConfigMap or Secret volume is noticed as well.
+func (r *configReloader) filesDigest() [sha256.Size]byte {
+	hash := sha256.New()
+	for _, file := range r.watchedFiles() {
+		if file == "" {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			// unreadable files are reported by the reload they trigger
+			data = []byte(err.Error())
+		}
+		hash.Write([]byte(file))
+		hash.Write([]byte{0})
+		hash.Write(data)
+		hash.Write([]byte{0})
+	}
+	var digest [sha256.Size]byte
+	copy(digest[:], hash.Sum(nil))
+	return digest
+}
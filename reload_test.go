@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func writeConfig(t *testing.T, path string, data string) {
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForConfig waits until the active configuration satisfies ok.
+func waitForConfig(t *testing.T, ok func(*proxyConfig) bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !ok(currentProxyConfig()) {
+		if time.Now().After(deadline) {
+			t.Fatal("configuration not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, `{"routes": [{"name": "invoices", "path": "/invoices"}]}`)
+	defer activeConfig.Store(nil)
+
+	reloader := newConfigReloader(path, 0)
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig(t, path, `{"redirect_url": "https://wallet.example.com", "routes": [{"name": "wallets", "path": "/wallets"}]}`)
+	successes := testutil.ToFloat64(configReloads.WithLabelValues("success"))
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	config := currentProxyConfig()
+	if len(config.Routes) != 1 || config.Routes[0].Name != "wallets" || config.redirectURL() != "https://wallet.example.com" {
+		t.Errorf("configuration not swapped: %+v", config)
+	}
+	if got := testutil.ToFloat64(configReloads.WithLabelValues("success")); got != successes+1 {
+		t.Errorf("got %v successful reloads want %v", got, successes+1)
+	}
+
+	// an invalid configuration is refused and the active one kept
+	writeConfig(t, path, `{"routes": [{"name": "wallets", "path": "wallets"}]}`)
+	failures := testutil.ToFloat64(configReloads.WithLabelValues("failure"))
+	if err := reloader.reload(); err == nil {
+		t.Errorf("invalid configuration accepted")
+	}
+	if currentProxyConfig() != config {
+		t.Errorf("active configuration replaced by an invalid one")
+	}
+	if got := testutil.ToFloat64(configReloads.WithLabelValues("failure")); got != failures+1 {
+		t.Errorf("got %v failed reloads want %v", got, failures+1)
+	}
+	if got := testutil.ToFloat64(configLastReloadSuccess); got != 0 {
+		t.Errorf("last reload reported successful")
+	}
+
+	// so is an upstream no request could be forwarded to
+	for _, upstream := range []string{"https://u:p@wallet.example.com", "https://wallet.example.com/base?k=v", "https://wallet.example.com#f", "wallet.example.com"} {
+		writeConfig(t, path, `{"redirect_url": "`+upstream+`"}`)
+		if err := reloader.reload(); err == nil {
+			t.Errorf("%s: upstream accepted", upstream)
+		}
+		if currentProxyConfig() != config {
+			t.Errorf("%s: active configuration replaced", upstream)
+		}
+	}
+
+}
+
+func TestConfigReloadTriggers(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	tokenPath := filepath.Join(dir, "token")
+	writeConfig(t, path, `{}`)
+	writeConfig(t, tokenPath, "token\n")
+	t.Setenv("TOKEN_FILE", tokenPath)
+	defer activeConfig.Store(nil)
+
+	hangups := make(chan os.Signal, 1)
+	reloader := newConfigReloader(path, 10*time.Millisecond)
+	reloader.start(hangups)
+	defer reloader.close()
+
+	// a change of the config file
+	writeConfig(t, path, `{"routes": [{"name": "wallets", "path": "/wallets"}]}`)
+	waitForConfig(t, func(c *proxyConfig) bool { return len(c.Routes) == 1 })
+	if got := currentProxyConfig().secret("TOKEN"); got != "token" {
+		t.Errorf("got token %q want token", got)
+	}
+
+	// a change of a secret file
+	writeConfig(t, tokenPath, "rotated-token\n")
+	waitForConfig(t, func(c *proxyConfig) bool { return c.secret("TOKEN") == "rotated-token" })
+
+	// SIGHUP reloads even when nothing changed
+	before := currentProxyConfig()
+	hangups <- os.Interrupt
+	waitForConfig(t, func(c *proxyConfig) bool { return c != before })
+
+}
+
+func TestConfigReloadKeepsInFlightRequests(t *testing.T) {
+
+	release := make(chan struct{})
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = w.Write([]byte("old"))
+	}))
+	defer old.Close()
+	current := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("new"))
+	}))
+	defer current.Close()
+
+	t.Setenv("REDIRECT_URL", "")
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, `{"redirect_url": "`+old.URL+`"}`)
+	defer activeConfig.Store(nil)
+	reloader := newConfigReloader(path, 0)
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rr := httptest.NewRecorder()
+		newMux().ServeHTTP(rr, httptest.NewRequest("GET", "/wallets", nil))
+		done <- rr
+	}()
+	// wait for the request to be sent upstream
+	time.Sleep(50 * time.Millisecond)
+
+	writeConfig(t, path, `{"redirect_url": "`+current.URL+`"}`)
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	newMux().ServeHTTP(rr, httptest.NewRequest("GET", "/wallets", nil))
+	if rr.Body.String() != "new" {
+		t.Errorf("new request not sent to the new upstream: %q", rr.Body.String())
+	}
+
+	close(release)
+	if rr := <-done; rr.Body.String() != "old" {
+		t.Errorf("in-flight request not finished on the old upstream: %q", rr.Body.String())
+	}
+
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// requestIDHeader carries the ID correlating a request across the client,
+// this service and the upstream.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the IDs accepted from clients.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestIDs keeps the request ID sent by the client, or generates a
+// UUIDv7 when it is missing or malformed. The ID is forwarded upstream,
+// echoed in the response and stored in the request context.
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		request.Header.Set(requestIDHeader, id)
+		writer.Header().Set(requestIDHeader, id)
+
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), requestIDKey{}, id)))
+	})
+}
+
+func newRequestID() string {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return uuid.NewString()
+	}
+	return id.String()
+}
+
+// validRequestID accepts IDs of printable ASCII characters, so they can't
+// be used to inject headers or log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFrom returns the ID of the request the context belongs to.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// httpError answers the request with an error message that includes the
+// request ID, so clients can report it.
+func httpError(writer http.ResponseWriter, request *http.Request, message string, code int) {
+	if id := requestIDFrom(request.Context()); id != "" {
+		message = fmt.Sprintf("%s (request id %s)", message, id)
+	}
+	http.Error(writer, message, code)
+}
+
+// violation is a problem found in a field of a request, such as a query
+// parameter.
+type violation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// violationsError answers the request with every violation found, as JSON,
+// so clients can fix them all at once.
+func violationsError(writer http.ResponseWriter, request *http.Request, message string, code int, violations []violation) {
+	writeJSON(writer, code, struct {
+		Error      string      `json:"error"`
+		RequestID  string      `json:"request_id,omitempty"`
+		Violations []violation `json:"violations"`
+	}{message, requestIDFrom(request.Context()), violations})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRequestIDGenerated(t *testing.T) {
+
+	// Create a test server that echoes the request ID it receives
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get(requestIDHeader)))
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := captureLogs(t, "info")
+
+	rr := httptest.NewRecorder()
+	newMux().ServeHTTP(rr, httptest.NewRequest("GET", "/wallets", nil))
+
+	id := rr.Header().Get(requestIDHeader)
+	parsed, err := uuid.Parse(id)
+	if err != nil || parsed.Version() != 7 {
+		t.Fatalf("response request ID is not a UUIDv7: %q", id)
+	}
+	if rr.Body.String() != id {
+		t.Errorf("upstream received request ID %q want %q", rr.Body.String(), id)
+	}
+	if !strings.Contains(logs.String(), `"request_id":"`+id+`"`) {
+		t.Errorf("request ID missing from the logs: %s", logs)
+	}
+
+}
+
+func TestRequestIDFromClient(t *testing.T) {
+
+	// Create a test server that echoes the request ID it receives
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get(requestIDHeader)))
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, kept := range map[string]bool{
+		"wallet-app-4f1c2a":      true,
+		"01HF8ZQ7V3K9J2M4N6P8R0": true,
+		"has space":              false,
+		strings.Repeat("a", 129): false,
+	} {
+		req := httptest.NewRequest("GET", "/wallets", nil)
+		req.Header.Set(requestIDHeader, id)
+		rr := httptest.NewRecorder()
+		newMux().ServeHTTP(rr, req)
+
+		got := rr.Header().Get(requestIDHeader)
+		if kept && got != id || !kept && (got == id || got == "") {
+			t.Errorf("client request ID %q: got %q", id, got)
+		}
+		if rr.Body.String() != got {
+			t.Errorf("upstream received request ID %q want %q", rr.Body.String(), got)
+		}
+	}
+
+}
+
+func TestRequestIDInErrorBody(t *testing.T) {
+
+	err := os.Setenv("REDIRECT_URL", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/wallets", nil)
+	req.Header.Set(requestIDHeader, "wallet-app-4f1c2a")
+	rr := httptest.NewRecorder()
+	newMux().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusInternalServerError)
+	}
+	if !strings.Contains(rr.Body.String(), "wallet-app-4f1c2a") {
+		t.Errorf("request ID missing from the error body: %q", rr.Body.String())
+	}
+
+}
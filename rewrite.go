@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rewriteRule maps the path of a request to the path forwarded upstream.
+// From is either a template, where {name} stands for one path segment, or
+// with Regex a regular expression; either must match the whole path.
+type rewriteRule struct {
+	// From is matched against the normalized, escaped request path, such
+	// as /v1/wallet/{id}.
+	From string `json:"from"`
+	// To is the forwarded path, such as /api/wallets/{id}/summary. With
+	// Regex, groups are referred to as $1 or ${name}.
+	To string `json:"to"`
+	// Regex makes From a regular expression instead of a template.
+	Regex bool `json:"regex,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// templateVariable matches the {name} placeholders of templates and
+// header values.
+var templateVariable = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+func (r *rewriteRule) validate() error {
+	if !strings.HasPrefix(r.From, "/") && !r.Regex {
+		return fmt.Errorf("rewrite %s: from must start with /", r.From)
+	}
+	if !strings.HasPrefix(r.To, "/") {
+		return fmt.Errorf("rewrite %s: to must start with /", r.From)
+	}
+
+	if r.Regex {
+		pattern, err := regexp.Compile("^(?:" + r.From + ")$")
+		if err != nil {
+			return fmt.Errorf("rewrite %s: %v", r.From, err)
+		}
+		r.pattern = pattern
+		return nil
+	}
+
+	// every placeholder becomes a named group matching one segment
+	names := map[string]bool{}
+	var expr strings.Builder
+	last := 0
+	for _, match := range templateVariable.FindAllStringSubmatchIndex(r.From, -1) {
+		name := r.From[match[2]:match[3]]
+		if name[0] >= '0' && name[0] <= '9' {
+			return fmt.Errorf("rewrite %s: variable %s must not start with a digit", r.From, name)
+		}
+		if names[name] {
+			return fmt.Errorf("rewrite %s: duplicated variable %s", r.From, name)
+		}
+		names[name] = true
+		expr.WriteString(regexp.QuoteMeta(r.From[last:match[0]]))
+		expr.WriteString("(?P<" + name + ">[^/]+)")
+		last = match[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(r.From[last:]))
+	if strings.ContainsAny(templateVariable.ReplaceAllString(r.From, ""), "{}") {
+		return fmt.Errorf("rewrite %s: invalid placeholder", r.From)
+	}
+	for _, match := range templateVariable.FindAllStringSubmatch(r.To, -1) {
+		if !names[match[1]] {
+			return fmt.Errorf("rewrite %s: unknown variable %s in %s", r.From, match[1], r.To)
+		}
+	}
+	r.pattern = regexp.MustCompile("^" + expr.String() + "$")
+	return nil
+}
+
+// rewrite returns the path to forward and the variables captured from
+// path, with their values unescaped. The path is unchanged when no rule
+// matches. Numbered groups of regular expressions are variables as well.
+func rewrite(rules []*rewriteRule, path string) (string, map[string]string, error) {
+	for _, r := range rules {
+		match := r.pattern.FindStringSubmatchIndex(path)
+		if match == nil {
+			continue
+		}
+
+		vars := map[string]string{}
+		for i, name := range r.pattern.SubexpNames() {
+			if i == 0 || match[2*i] < 0 {
+				continue
+			}
+			value, err := url.PathUnescape(path[match[2*i]:match[2*i+1]])
+			if err != nil {
+				return "", nil, err
+			}
+			vars[strconv.Itoa(i)] = value
+			if name != "" {
+				vars[name] = value
+			}
+		}
+
+		var rewritten string
+		if r.Regex {
+			rewritten = string(r.pattern.ExpandString(nil, r.To, path, match))
+		} else {
+			rewritten = templateVariable.ReplaceAllStringFunc(r.To, func(placeholder string) string {
+				return url.PathEscape(vars[placeholder[1:len(placeholder)-1]])
+			})
+		}
+		// a rewritten path is held to the same rules as a requested one
+		rewritten, err := normalizePath(rewritten)
+		if err != nil {
+			return "", nil, fmt.Errorf("rewritten path: %v", err)
+		}
+		return rewritten, vars, nil
+	}
+	return path, nil, nil
+}
+
+// expandVariables replaces the {name} placeholders of value with vars,
+// leaving the placeholders of unknown variables as they are.
+func expandVariables(value string, vars map[string]string) string {
+	if len(vars) == 0 || !strings.Contains(value, "{") {
+		return value
+	}
+	return templateVariable.ReplaceAllStringFunc(value, func(placeholder string) string {
+		if v, ok := vars[placeholder[1:len(placeholder)-1]]; ok {
+			return v
+		}
+		return placeholder
+	})
+}
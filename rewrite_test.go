@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+
+	rules := []*rewriteRule{
+		{From: "/v1/wallet/{id}", To: "/api/wallets/{id}/summary"},
+		{From: "/v1/wallet/{id}/tx/{tx}", To: "/api/tx/{tx}?wallet={id}"},
+		{From: `/v2/(?P<kind>invoices|payments)/(\d+)`, To: "/api/${kind}/$2", Regex: true},
+		{From: `/v3/(.*)`, To: "/api/$1", Regex: true},
+		{From: `/v4/(.*)`, To: "/api/$1/..", Regex: true},
+	}
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		path string
+		want string
+		vars map[string]string
+		ok   bool
+	}{
+		{"/v1/wallet/42", "/api/wallets/42/summary", map[string]string{"id": "42", "1": "42"}, true},
+		{"/v1/wallet/a%20b", "/api/wallets/a%20b/summary", map[string]string{"id": "a b", "1": "a b"}, true},
+		{"/v1/wallet/42/extra", "/v1/wallet/42/extra", nil, true},
+		{"/v1/wallet/42/tx/7", "/api/tx/7%3Fwallet=42", map[string]string{"id": "42", "tx": "7", "1": "42", "2": "7"}, true},
+		{"/v2/payments/12", "/api/payments/12", map[string]string{"kind": "payments", "1": "payments", "2": "12"}, true},
+		{"/v2/refunds/12", "/v2/refunds/12", nil, true},
+		{"/v3/a/b", "/api/a/b", map[string]string{"1": "a/b"}, true},
+		{"/v3/a/..b", "/api/a/..b", map[string]string{"1": "a/..b"}, true},
+		{"/v4/a", "", nil, false},
+	} {
+		got, vars, err := rewrite(rules, tc.path)
+		if (err == nil) != tc.ok || got != tc.want || !reflect.DeepEqual(vars, tc.vars) {
+			t.Errorf("%s: got %q, %v, %v want %q, %v", tc.path, got, vars, err, tc.want, tc.vars)
+		}
+	}
+
+}
+
+func TestRewriteRuleValidate(t *testing.T) {
+
+	for _, r := range []*rewriteRule{
+		{From: "v1/wallet/{id}", To: "/api"},
+		{From: "/v1/wallet/{id}", To: "api/{id}"},
+		{From: "/v1/wallet/{id}", To: "/api/{wallet}"},
+		{From: "/v1/{id}/{id}", To: "/api/{id}"},
+		{From: "/v1/{1}", To: "/api/{1}"},
+		{From: "/v1/{id", To: "/api"},
+		{From: "/v1/(", To: "/api", Regex: true},
+	} {
+		if err := r.validate(); err == nil {
+			t.Errorf("%+v: invalid rule accepted", r)
+		}
+	}
+
+}
+
+func TestExpandVariables(t *testing.T) {
+
+	vars := map[string]string{"id": "42"}
+	for value, want := range map[string]string{
+		"wallet-{id}":  "wallet-42",
+		"{id}/{id}":    "42/42",
+		"{unknown}":    "{unknown}",
+		"{ id }":       "{ id }",
+		"no variables": "no variables",
+	} {
+		if got := expandVariables(value, vars); got != want {
+			t.Errorf("%q: got %q want %q", value, got, want)
+		}
+	}
+
+}
+
+func TestRedirectRewrite(t *testing.T) {
+
+	var forwarded, wallet string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.URL.RequestURI()
+		wallet = r.Header.Get("X-Wallet-ID")
+	}))
+	defer ts.Close()
+
+	t.Setenv("REDIRECT_URL", ts.URL)
+	activeConfig.Store(mustProxyConfig(t, `{
+		"routes": [{
+			"name": "wallets",
+			"path": "/v1/wallet",
+			"rewrite": [
+				{"from": "/v1/wallet/{id}", "to": "/api/wallets/{id}/summary"},
+				{"from": "/v1/wallet/(.*)", "to": "/api/$1", "regex": true}
+			],
+			"headers": {"set": {"X-Wallet-ID": "{id}"}}
+		}]
+	}`))
+	defer activeConfig.Store(nil)
+
+	for _, tc := range []struct {
+		path      string
+		status    int
+		forwarded string
+		wallet    string
+	}{
+		{"/v1/wallet/42?verbose=1", http.StatusOK, "/api/wallets/42/summary?verbose=1", "42"},
+		{"/v1/wallet/42/history", http.StatusOK, "/api/42/history", "{id}"},
+		{"/v1/other", http.StatusOK, "/v1/other", ""},
+	} {
+		forwarded, wallet = "", ""
+		rr := httptest.NewRecorder()
+		newMux().ServeHTTP(rr, httptest.NewRequest("GET", tc.path, nil))
+		if rr.Code != tc.status || forwarded != tc.forwarded || wallet != tc.wallet {
+			t.Errorf("%s: got status %v forwarded to %q with wallet %q", tc.path, rr.Code, forwarded, wallet)
+		}
+	}
+
+}
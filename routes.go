@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// defaultMaxBodyBytes caps POST and PUT bodies when no limit is configured.
+const defaultMaxBodyBytes = 1 << 20
+
+// route is a set of request handling settings applied to the requests
+// whose path starts with Path and whose method is one of Methods.
+type route struct {
+	Name    string   `json:"name"`
+	Path    string   `json:"path"`
+	Methods []string `json:"methods,omitempty"`
+
+	// MaxBodyBytes overrides the global body size limit when set.
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+	// RateLimits override the global rate limits when set.
+	RateLimits *rateLimits `json:"rate_limits,omitempty"`
+	// Concurrency overrides the global concurrency limit when set.
+	Concurrency *concurrencyLimit `json:"concurrency,omitempty"`
+	// Headers replaces the global header policy when set.
+	Headers *headerPolicy `json:"headers,omitempty"`
+	// Content replaces the global content policy when set.
+	Content *contentPolicy `json:"content,omitempty"`
+	// CORS replaces the global CORS policy when set.
+	CORS *corsPolicy `json:"cors,omitempty"`
+	// Query declares the query parameters the route accepts.
+	Query *querySchema `json:"query,omitempty"`
+	// Rewrite maps request paths to upstream paths, the first matching
+	// rule applies.
+	Rewrite []*rewriteRule `json:"rewrite,omitempty"`
+	// ResponseBody transforms the JSON responses of the route.
+	ResponseBody *responseTransform `json:"response_body,omitempty"`
+	// ForwardQuery overrides the global forward_query when set.
+	ForwardQuery string `json:"forward_query,omitempty"`
+	// BodySchema is the file of the schema directory POST and PUT bodies
+	// are validated against.
+	BodySchema string `json:"body_schema,omitempty"`
+
+	bodySchema *jsonschema.Schema
+}
+
+// proxyConfig is the request handling configuration of the proxy, loaded
+// from the optional config file.
+type proxyConfig struct {
+	// RedirectURL is the upstream, REDIRECT_URL when not set.
+	RedirectURL  string      `json:"redirect_url,omitempty"`
+	MaxBodyBytes int64       `json:"max_body_bytes,omitempty"`
+	RateLimits   *rateLimits `json:"rate_limits,omitempty"`
+	// Concurrency caps the requests of each route in flight upstream.
+	Concurrency *concurrencyLimit `json:"concurrency,omitempty"`
+	// TrustedProxies are the addresses or CIDRs allowed to set
+	// X-Forwarded-For, usually the ingress controller.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	// Headers is the header policy of the routes that don't set one.
+	Headers *headerPolicy `json:"headers,omitempty"`
+	// CORS is the CORS policy of the routes that don't set one.
+	CORS *corsPolicy `json:"cors,omitempty"`
+	// ClientNames names clients by the fingerprint of their key, for the
+	// client_name header variable.
+	ClientNames map[string]string `json:"client_names,omitempty"`
+	// Content is the content policy of the routes that don't set one.
+	Content *contentPolicy `json:"content,omitempty"`
+	// ForwardQuery is how queries are forwarded: encoded or raw.
+	ForwardQuery string `json:"forward_query,omitempty"`
+	// SchemaDir holds the JSON Schemas routes refer to.
+	SchemaDir string   `json:"schema_dir,omitempty"`
+	Routes    []*route `json:"routes,omitempty"`
+
+	trustedNetworks []*net.IPNet
+	// secrets holds the keys read from the files named by the *_FILE
+	// variables, see secret.
+	secrets map[string]string
+	// schemaFiles are the files of the schema directory.
+	schemaFiles []string
+}
+
+// defaultRoute matches every request no configured route matches.
+var defaultRoute = &route{Name: "default", Path: "/"}
+
+// activeConfig is the configuration requests are handled with, see
+// currentProxyConfig.
+var activeConfig atomic.Pointer[proxyConfig]
+
+// currentProxyConfig returns the active configuration, or the defaults
+// when none has been loaded.
+func currentProxyConfig() *proxyConfig {
+	if config := activeConfig.Load(); config != nil {
+		return config
+	}
+	return &proxyConfig{MaxBodyBytes: defaultMaxBodyBytes}
+}
+
+type proxyConfigKey struct{}
+
+// withProxyConfig pins the active configuration for the whole request, so
+// a reload never applies half way through a request.
+func withProxyConfig(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := context.WithValue(request.Context(), proxyConfigKey{}, currentProxyConfig())
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// proxyConfigFrom returns the configuration the request is handled with.
+func proxyConfigFrom(ctx context.Context) *proxyConfig {
+	if config, ok := ctx.Value(proxyConfigKey{}).(*proxyConfig); ok {
+		return config
+	}
+	return currentProxyConfig()
+}
+
+// secretFiles are the secrets that can be read from a file, such as a
+// mounted Kubernetes secret, instead of the environment. The file is named
+// by the variable with a _FILE suffix.
+var secretFiles = []string{"TOKEN", "X_API_KEY", "ADMIN_TOKEN"}
+
+// redirectURL returns the upstream requests are forwarded to.
+func (c *proxyConfig) redirectURL() string {
+	if c.RedirectURL != "" {
+		return c.RedirectURL
+	}
+	return os.Getenv("REDIRECT_URL")
+}
+
+// secret returns the secret read from its file when the configuration was
+// loaded, or from the environment.
+func (c *proxyConfig) secret(name string) string {
+	if value, ok := c.secrets[name]; ok {
+		return value
+	}
+	return os.Getenv(name)
+}
+
+// loadProxyConfig reads the config file at path, a missing path only
+// applies the defaults. MAX_BODY_BYTES overrides the global body limit.
+func loadProxyConfig(path string) (*proxyConfig, error) {
+	config := &proxyConfig{}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("error reading config file: %v", err)
+		}
+		if err == nil {
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(config); err != nil {
+				return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+			}
+		}
+	}
+
+	maxBodyBytes, err := envInt("MAX_BODY_BYTES", int(config.MaxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	config.MaxBodyBytes = int64(maxBodyBytes)
+	if config.MaxBodyBytes == 0 {
+		config.MaxBodyBytes = defaultMaxBodyBytes
+	}
+
+	for _, name := range secretFiles {
+		file := os.Getenv(name + "_FILE")
+		if file == "" {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s_FILE: %v", name, err)
+		}
+		if config.secrets == nil {
+			config.secrets = map[string]string{}
+		}
+		config.secrets[name] = strings.TrimSpace(string(data))
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.loadSchemas(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *proxyConfig) validate() error {
+	if c.MaxBodyBytes < 0 {
+		return fmt.Errorf("max_body_bytes must not be negative")
+	}
+	if c.RedirectURL != "" {
+		// the same rules as every request, so a reload can't swap in an
+		// upstream no request can be forwarded to
+		if _, err := parseUpstream(c.RedirectURL); err != nil {
+			return fmt.Errorf("redirect_url: %v", err)
+		}
+	}
+	if err := c.RateLimits.validate(); err != nil {
+		return err
+	}
+	if err := c.Concurrency.validate(); err != nil {
+		return err
+	}
+	if err := c.Headers.validate(); err != nil {
+		return err
+	}
+	if err := c.Content.validate(); err != nil {
+		return err
+	}
+	if err := c.CORS.validate(); err != nil {
+		return err
+	}
+	if err := validateForwardQuery(c.ForwardQuery); err != nil {
+		return err
+	}
+	for id, name := range c.ClientNames {
+		if err := defaultHeaderPolicy.checkValue(name); err != nil {
+			return fmt.Errorf("client_names: name of %s: %v", id, err)
+		}
+	}
+
+	c.trustedNetworks = nil
+	for _, proxy := range c.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy: %v", err)
+		}
+		c.trustedNetworks = append(c.trustedNetworks, network)
+	}
+
+	names := map[string]bool{defaultRoute.Name: true}
+	for i, r := range c.Routes {
+		if r.Name == "" {
+			return fmt.Errorf("route %d: name is required", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("route %s: duplicated name", r.Name)
+		}
+		names[r.Name] = true
+
+		if !strings.HasPrefix(r.Path, "/") {
+			return fmt.Errorf("route %s: path must start with /", r.Name)
+		}
+		for j, method := range r.Methods {
+			r.Methods[j] = strings.ToUpper(method)
+		}
+		if r.MaxBodyBytes < 0 {
+			return fmt.Errorf("route %s: max_body_bytes must not be negative", r.Name)
+		}
+		if err := r.RateLimits.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		if err := r.Concurrency.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		if err := r.Headers.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		if err := r.Content.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		if err := r.CORS.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		if err := r.Query.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		if err := validateForwardQuery(r.ForwardQuery); err != nil {
+			return fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		if err := r.ResponseBody.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", r.Name, err)
+		}
+		for _, rule := range r.Rewrite {
+			if rule == nil {
+				return fmt.Errorf("route %s: empty rewrite rule", r.Name)
+			}
+			if err := rule.validate(); err != nil {
+				return fmt.Errorf("route %s: %v", r.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// match returns the route with the longest path prefix matching the
+// request, or the default route.
+func (c *proxyConfig) match(request *http.Request) *route {
+	// invalid paths aren't routed, they are refused on the default route
+	if pathError(request.Context()) != nil {
+		return defaultRoute
+	}
+	var matched *route
+	for _, r := range c.Routes {
+		if !pathHasPrefix(request.URL.Path, r.Path) {
+			continue
+		}
+		if len(r.Methods) > 0 && !contains(r.Methods, request.Method) {
+			continue
+		}
+		if matched == nil || len(r.Path) > len(matched.Path) {
+			matched = r
+		}
+	}
+	if matched == nil {
+		return defaultRoute
+	}
+	return matched
+}
+
+// pathHasPrefix reports whether prefix is made of whole segments of path,
+// so /invoices matches /invoices/1 but not /invoices-archive.
+func pathHasPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// maxBodyBytes returns the body size limit of the route.
+func (c *proxyConfig) maxBodyBytes(r *route) int64 {
+	if r.MaxBodyBytes > 0 {
+		return r.MaxBodyBytes
+	}
+	return c.MaxBodyBytes
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRouteMatch(t *testing.T) {
+
+	config := &proxyConfig{Routes: []*route{
+		{Name: "wallets", Path: "/wallets"},
+		{Name: "wallet-writes", Path: "/wallets", Methods: []string{"POST", "PUT"}},
+		{Name: "wallet-balance", Path: "/wallets/balance"},
+	}}
+
+	for _, tc := range []struct {
+		method, path, want string
+	}{
+		{"GET", "/wallets", "wallets"},
+		{"GET", "/wallets/1", "wallets"},
+		{"GET", "/wallets/balance/1", "wallet-balance"},
+		{"POST", "/wallets/1", "wallets"},
+		{"GET", "/wallets-archive", "default"},
+		{"GET", "/invoices", "default"},
+	} {
+		got := config.match(httptest.NewRequest(tc.method, tc.path, nil)).Name
+		if got != tc.want {
+			t.Errorf("%s %s: matched route %q want %q", tc.method, tc.path, got, tc.want)
+		}
+	}
+
+}
+
+func TestLoadProxyConfig(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{
+		"max_body_bytes": 2048,
+		"routes": [{"name": "invoices", "path": "/invoices", "methods": ["post"], "max_body_bytes": 512}]
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadProxyConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxBodyBytes != 2048 {
+		t.Errorf("unexpected global body limit: got %v want %v", config.MaxBodyBytes, 2048)
+	}
+
+	r := config.match(httptest.NewRequest("POST", "/invoices", nil))
+	if r.Name != "invoices" || config.maxBodyBytes(r) != 512 {
+		t.Errorf("unexpected route: %+v", r)
+	}
+
+	// MAX_BODY_BYTES takes precedence over the file
+	t.Setenv("MAX_BODY_BYTES", "4096")
+	config, err = loadProxyConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxBodyBytes != 4096 {
+		t.Errorf("unexpected global body limit: got %v want %v", config.MaxBodyBytes, 4096)
+	}
+
+}
+
+func TestLoadProxyConfigDefaults(t *testing.T) {
+
+	config, err := loadProxyConfig(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxBodyBytes != defaultMaxBodyBytes || len(config.Routes) != 0 {
+		t.Errorf("unexpected default config: %+v", config)
+	}
+
+}
+
+func TestLoadProxyConfigInvalid(t *testing.T) {
+
+	for name, content := range map[string]string{
+		"syntax":         `{"routes": [`,
+		"unknown field":  `{"max_body": 1}`,
+		"missing name":   `{"routes": [{"path": "/a"}]}`,
+		"duplicate name": `{"routes": [{"name": "a", "path": "/a"}, {"name": "a", "path": "/b"}]}`,
+		"relative path":  `{"routes": [{"name": "a", "path": "a"}]}`,
+		"negative limit": `{"routes": [{"name": "a", "path": "/a", "max_body_bytes": -1}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadProxyConfig(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+}
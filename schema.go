@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// loadSchemas compiles every JSON Schema of the schema directory, so a
+// broken schema is reported when the configuration is loaded, and gives
+// each route the schema named by its body_schema. A relative directory is
+// relative to the directory of the config file.
+func (c *proxyConfig) loadSchemas(configDir string) error {
+	var routes []*route
+	for _, r := range c.Routes {
+		if r.BodySchema != "" {
+			routes = append(routes, r)
+		}
+	}
+	if c.SchemaDir == "" {
+		if len(routes) > 0 {
+			return fmt.Errorf("route %s: body_schema requires schema_dir", routes[0].Name)
+		}
+		return nil
+	}
+
+	dir := c.SchemaDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(configDir, dir)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	compiler := jsonschema.NewCompiler()
+	// schemas may only refer to each other, never to the network
+	compiler.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("%s is not in the schema directory", s)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("error reading schema: %v", err)
+		}
+		if err := compiler.AddResource(schemaURL(file), bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("invalid schema %s: %v", filepath.Base(file), err)
+		}
+	}
+
+	schemas := map[string]*jsonschema.Schema{}
+	for _, file := range files {
+		schema, err := compiler.Compile(schemaURL(file))
+		if err != nil {
+			return fmt.Errorf("invalid schema %s: %v", filepath.Base(file), err)
+		}
+		schemas[filepath.Base(file)] = schema
+	}
+	c.schemaFiles = files
+
+	for _, r := range routes {
+		schema, ok := schemas[r.BodySchema]
+		if !ok {
+			return fmt.Errorf("route %s: schema %s not found in %s", r.Name, r.BodySchema, dir)
+		}
+		r.bodySchema = schema
+	}
+	return nil
+}
+
+func schemaURL(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// checkBody validates a JSON body against the schema of the route and
+// returns every violation, located by JSON pointer.
+func (r *route) checkBody(body []byte) []violation {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return []violation{{Field: "", Message: fmt.Sprintf("invalid JSON: %v", err)}}
+	}
+	if decoder.More() {
+		return []violation{{Field: "", Message: "invalid JSON: unexpected data after the document"}}
+	}
+
+	err := r.bodySchema.Validate(document)
+	var invalid *jsonschema.ValidationError
+	if !errors.As(err, &invalid) {
+		return nil
+	}
+
+	// only the innermost errors say what is wrong, their parents say which
+	// part of the schema failed
+	var violations []violation
+	var leaves func(*jsonschema.ValidationError)
+	leaves = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			violations = append(violations, violation{Field: e.InstanceLocation, Message: e.Message})
+		}
+		for _, cause := range e.Causes {
+			leaves(cause)
+		}
+	}
+	leaves(invalid)
+
+	sort.SliceStable(violations, func(i, j int) bool { return violations[i].Field < violations[j].Field })
+	return violations
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeSchemas writes a schema directory next to a config file using it
+// and returns the path of the config file.
+func writeSchemas(t *testing.T, schemas map[string]string, config string) string {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "schemas"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, schema := range schemas {
+		if err := os.WriteFile(filepath.Join(dir, "schemas", name), []byte(schema), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSchemas(t *testing.T) {
+
+	path := writeSchemas(t, map[string]string{
+		"amount.json":  `{"type": "integer", "minimum": 1}`,
+		"payment.json": `{"type": "object", "required": ["amount"], "properties": {"amount": {"$ref": "amount.json"}}}`,
+	}, `{"schema_dir": "schemas", "routes": [{"name": "payments", "path": "/payments", "body_schema": "payment.json"}]}`)
+
+	config, err := loadProxyConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := config.Routes[0]
+	if violations := r.checkBody([]byte(`{"amount": 10}`)); len(violations) != 0 {
+		t.Errorf("valid body refused: %v", violations)
+	}
+	want := []violation{{Field: "/amount", Message: "must be >= 1 but found 0"}}
+	if violations := r.checkBody([]byte(`{"amount": 0}`)); !reflect.DeepEqual(violations, want) {
+		t.Errorf("got violations %v want %v", violations, want)
+	}
+
+}
+
+func TestLoadSchemasInvalid(t *testing.T) {
+
+	for name, tc := range map[string]struct {
+		schemas map[string]string
+		config  string
+	}{
+		"invalid schema": {
+			map[string]string{"a.json": `{"type": "integer", "minimum": "one"}`},
+			`{"schema_dir": "schemas"}`,
+		},
+		"missing schema": {
+			map[string]string{"a.json": `{}`},
+			`{"schema_dir": "schemas", "routes": [{"name": "b", "path": "/b", "body_schema": "b.json"}]}`,
+		},
+		"remote reference": {
+			map[string]string{"a.json": `{"$ref": "https://example.com/schema.json"}`},
+			`{"schema_dir": "schemas"}`,
+		},
+		"no schema directory": {
+			nil,
+			`{"routes": [{"name": "b", "path": "/b", "body_schema": "b.json"}]}`,
+		},
+	} {
+		if _, err := loadProxyConfig(writeSchemas(t, tc.schemas, tc.config)); err == nil {
+			t.Errorf("%s: configuration accepted", name)
+		}
+	}
+
+}
+
+func TestRedirectBodySchema(t *testing.T) {
+
+	forwarded := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+	}))
+	defer ts.Close()
+
+	schema, err := os.ReadFile("schemas/invoice.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeSchemas(t, map[string]string{"invoice.json": string(schema)},
+		`{"schema_dir": "schemas", "routes": [{"name": "invoices", "path": "/invoices", "body_schema": "invoice.json"}]}`)
+	config, err := loadProxyConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REDIRECT_URL", ts.URL)
+	activeConfig.Store(config)
+	defer activeConfig.Store(nil)
+
+	for _, tc := range []struct {
+		body       string
+		status     int
+		violations []string
+	}{
+		{`{"invoice":"123456","status":"pending","wallet_id":"123"}`, http.StatusOK, nil},
+		{`{"invoice":"123456","status":"lost"}`, http.StatusUnprocessableEntity, []string{"", "/status"}},
+		{`{"invoice":"123456","status":"pending","wallet_id":"123","amount":1}`, http.StatusUnprocessableEntity, []string{""}},
+		{`{"invoice":`, http.StatusUnprocessableEntity, []string{""}},
+	} {
+		req := httptest.NewRequest("POST", "/invoices", strings.NewReader(tc.body))
+		rr := httptest.NewRecorder()
+		newMux().ServeHTTP(rr, req)
+
+		if rr.Code != tc.status {
+			t.Errorf("%s: got status %v want %v", tc.body, rr.Code, tc.status)
+			continue
+		}
+		if tc.status == http.StatusOK {
+			continue
+		}
+		var body struct {
+			Violations []violation `json:"violations"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("response is not JSON: %q", rr.Body.String())
+		}
+		var fields []string
+		for _, v := range body.Violations {
+			fields = append(fields, v.Field)
+		}
+		if !reflect.DeepEqual(fields, tc.violations) {
+			t.Errorf("%s: got violations %+v want fields %v", tc.body, body.Violations, tc.violations)
+		}
+	}
+	if forwarded != 1 {
+		t.Errorf("got %d requests forwarded want 1", forwarded)
+	}
+
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set once the service starts shutting down, readiness fails
+// from then on so no new traffic is routed to this instance.
+var draining atomic.Bool
+
+// shutdownConfig controls how the server drains on SIGTERM.
+type shutdownConfig struct {
+	// Delay between failing readiness and closing the listener, giving the
+	// load balancer time to stop routing to this instance.
+	Delay time.Duration
+	// DrainTimeout is how long in-flight requests are waited for.
+	DrainTimeout time.Duration
+}
+
+func shutdownConfigFromEnv() (shutdownConfig, error) {
+	config := shutdownConfig{
+		Delay:        0,
+		DrainTimeout: 30 * time.Second,
+	}
+
+	var err error
+	if config.Delay, err = envDuration("SHUTDOWN_DELAY", config.Delay); err != nil {
+		return config, err
+	}
+	if config.DrainTimeout, err = envDuration("DRAIN_TIMEOUT", config.DrainTimeout); err != nil {
+		return config, err
+	}
+	if config.Delay < 0 || config.DrainTimeout <= 0 {
+		return config, fmt.Errorf("SHUTDOWN_DELAY must not be negative and DRAIN_TIMEOUT must be positive")
+	}
+	return config, nil
+}
+
+// requestTracker counts the requests handled by the server.
+type requestTracker struct {
+	active atomic.Int64
+	served atomic.Int64
+}
+
+func (t *requestTracker) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		t.active.Add(1)
+		defer func() {
+			t.active.Add(-1)
+			t.served.Add(1)
+		}()
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// listening is an HTTP server together with the listener it serves on.
+type listening struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// newServer returns a server with the configured timeouts.
+func newServer(config serverConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+}
+
+// serve runs the servers until one of them fails or a signal is received,
+// then drains in-flight requests. It returns the process exit code.
+func serve(signals <-chan os.Signal, config shutdownConfig, servers ...listening) int {
+	tracker := &requestTracker{}
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		s.server.Handler = tracker.wrap(s.server.Handler)
+		go func(s listening) {
+			errs <- s.server.Serve(s.listener)
+		}(s)
+		slog.Info("Listening", "address", s.listener.Addr().String())
+	}
+
+	pending := len(servers)
+	code := 0
+	select {
+	case err := <-errs:
+		slog.Error("Server error", "error", err)
+		pending--
+		code = 1
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String())
+	}
+
+	draining.Store(true)
+	if config.Delay > 0 && code == 0 {
+		time.Sleep(config.Delay)
+	}
+
+	start := time.Now()
+	inFlight := tracker.active.Load()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+
+	for _, s := range servers {
+		if err := s.server.Shutdown(ctx); err != nil {
+			slog.Error("Drain timed out", "timeout", config.DrainTimeout, "in_flight", tracker.active.Load(), "error", err)
+			_ = s.server.Close()
+			code = 1
+		}
+	}
+	for ; pending > 0; pending-- {
+		if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server error", "error", err)
+			code = 1
+		}
+	}
+	checker.close()
+
+	slog.Info("Shutdown complete",
+		"served", tracker.served.Load(),
+		"in_flight_at_shutdown", inFlight,
+		"drain_duration", time.Since(start).Round(time.Millisecond),
+		"exit_code", code,
+	)
+	return code
+}
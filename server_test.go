@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	defer draining.Store(false)
+
+	// Create a handler that blocks until it is released
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("OK"))
+	})}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	code := make(chan int, 1)
+	go func() {
+		code <- serve(signals, shutdownConfig{DrainTimeout: 5 * time.Second}, listening{server, listener})
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	signals <- syscall.SIGTERM
+
+	// readiness fails as soon as the signal is handled
+	deadline := time.Now().Add(time.Second)
+	for !draining.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("service did not start draining after SIGTERM")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ready(); err == nil {
+		t.Errorf("readiness did not fail while draining")
+	}
+
+	close(release)
+
+	r := <-results
+	if r.err != nil || r.body != "OK" {
+		t.Errorf("in-flight request was not drained: body %q, error %v", r.body, r.err)
+	}
+	if c := <-code; c != 0 {
+		t.Errorf("serve returned wrong exit code: got %v want %v", c, 0)
+	}
+
+	// the listener no longer accepts connections
+	if _, err := http.Get("http://" + listener.Addr().String()); err == nil {
+		t.Errorf("server accepted a request after shutdown")
+	}
+
+}
+
+func TestServeDrainTimeout(t *testing.T) {
+	defer draining.Store(false)
+
+	// Create a handler that outlives the drain timeout
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	code := make(chan int, 1)
+	go func() {
+		code <- serve(signals, shutdownConfig{DrainTimeout: 50 * time.Millisecond}, listening{server, listener})
+	}()
+
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-started
+
+	signals <- syscall.SIGTERM
+
+	if c := <-code; c != 1 {
+		t.Errorf("serve returned wrong exit code: got %v want %v", c, 1)
+	}
+
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider keeping the spans in memory for
+// the rest of the test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return exporter
+}
+
+func TestTraceSpans(t *testing.T) {
+
+	// Create a test server that records the traceparent it receives
+	var traceparent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exporter := recordSpans(t)
+
+	// the client is already part of a trace
+	req := httptest.NewRequest("GET", "/wallets/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	newMux().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	server, ok := spans["GET default"]
+	if !ok {
+		t.Fatalf("server span missing: %v", exporter.GetSpans())
+	}
+	if server.SpanKind != trace.SpanKindServer || server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("server span doesn't continue the client trace: %+v", server.Parent)
+	}
+	if server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected trace ID: %v", server.SpanContext.TraceID())
+	}
+
+	for _, name := range []string{"validate", "authenticate", "upstream GET"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("span %s missing", name)
+			continue
+		}
+		if span.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("span %s is not a child of the server span", name)
+		}
+	}
+
+	upstream := spans["upstream GET"]
+	if upstream.SpanKind != trace.SpanKindClient {
+		t.Errorf("upstream span is not a client span")
+	}
+	want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + upstream.SpanContext.SpanID().String() + "-01"
+	if traceparent != want {
+		t.Errorf("upstream received traceparent %q want %q", traceparent, want)
+	}
+
+}
+
+func TestTraceSpansFailedValidation(t *testing.T) {
+
+	// Create a test server that returns a predefined response
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	err := os.Setenv("REDIRECT_URL", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exporter := recordSpans(t)
+
+	rr := httptest.NewRecorder()
+	newMux().ServeHTTP(rr, httptest.NewRequest("GET", "/wallets?key()=1", nil))
+
+	var names []string
+	for _, span := range exporter.GetSpans() {
+		names = append(names, span.Name)
+		if span.Name == "validate" && span.Status.Code != codes.Error {
+			t.Errorf("failed validation span not marked as an error")
+		}
+		if span.Name == "upstream GET" {
+			t.Errorf("invalid request was sent upstream")
+		}
+	}
+	if len(names) != 2 {
+		t.Errorf("unexpected spans: %v", names)
+	}
+
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// defaultMaxTransformBytes bounds the responses read to be transformed
+// when the route doesn't say otherwise.
+const defaultMaxTransformBytes = 10 << 20
+
+// responseTransform rewrites the JSON responses of a route, such as to hide
+// internal fields. Fields are selected by JSONPath. The allow list applies
+// first, then removals, then renames.
+type responseTransform struct {
+	// Allow lists the only fields sent to the client, all when empty.
+	Allow []string `json:"allow,omitempty"`
+	// Remove lists fields never sent to the client.
+	Remove []string `json:"remove,omitempty"`
+	// Rename gives fields a new name, by path.
+	Rename map[string]string `json:"rename,omitempty"`
+	// MaxBytes bounds the responses read to be transformed, larger ones
+	// are streamed unchanged. 10 MiB by default.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	allow  []*jsonPath
+	remove []*jsonPath
+	rename map[*jsonPath]string
+}
+
+func (t *responseTransform) validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.MaxBytes < 0 {
+		return fmt.Errorf("response_body: max_bytes must not be negative")
+	}
+	var err error
+	if t.allow, err = parseJSONPaths(t.Allow); err != nil {
+		return fmt.Errorf("response_body: %v", err)
+	}
+	if t.remove, err = parseJSONPaths(t.Remove); err != nil {
+		return fmt.Errorf("response_body: %v", err)
+	}
+	t.rename = map[*jsonPath]string{}
+	for expr, name := range t.Rename {
+		path, err := parseJSONPath(expr)
+		if err != nil {
+			return fmt.Errorf("response_body: %v", err)
+		}
+		if path.lastField() == "" || name == "" {
+			return fmt.Errorf("response_body: rename %s must select and name a field", expr)
+		}
+		t.rename[path] = name
+	}
+	return nil
+}
+
+func parseJSONPaths(exprs []string) ([]*jsonPath, error) {
+	paths := make([]*jsonPath, 0, len(exprs))
+	for _, expr := range exprs {
+		path, err := parseJSONPath(expr)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// body returns the body to send to the client and its length. Responses
+// that aren't uncompressed JSON, are too large or don't parse are streamed
+// as the upstream sends them, with a length of -1.
+func (t *responseTransform) body(resp *http.Response) (io.Reader, int) {
+	if t == nil || !jsonMediaType(resp.Header.Get("Content-Type")) || resp.Header.Get("Content-Encoding") != "" {
+		return resp.Body, -1
+	}
+	limit := t.MaxBytes
+	if limit == 0 {
+		limit = defaultMaxTransformBytes
+	}
+
+	buf := new(bytes.Buffer)
+	n, err := buf.ReadFrom(io.LimitReader(resp.Body, limit+1))
+	if err != nil || n > limit {
+		// what was read is sent first, then the rest of the body
+		return io.MultiReader(buf, resp.Body), -1
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil || decoder.More() {
+		return buf, -1
+	}
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(t.apply(document)); err != nil {
+		return buf, -1
+	}
+	transformed := bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+	return bytes.NewReader(transformed), len(transformed)
+}
+
+func jsonMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// apply transforms a decoded document in place and returns it.
+func (t *responseTransform) apply(document any) any {
+	if len(t.allow) > 0 {
+		document = allowOnly(document, t.allow)
+	}
+
+	for _, path := range t.remove {
+		locations := path.locations(document)
+		// the deepest first, so no removal moves another location
+		for i := len(locations) - 1; i >= 0; i-- {
+			location := locations[i]
+			if object, ok := valueAt(document, location[:len(location)-1]).(map[string]any); ok {
+				if key, ok := location[len(location)-1].(string); ok {
+					delete(object, key)
+				}
+			}
+		}
+	}
+
+	for path, name := range t.rename {
+		locations := path.locations(document)
+		for i := len(locations) - 1; i >= 0; i-- {
+			location := locations[i]
+			object, ok := valueAt(document, location[:len(location)-1]).(map[string]any)
+			key, isKey := location[len(location)-1].(string)
+			if !ok || !isKey || key == name {
+				continue
+			}
+			object[name] = object[key]
+			delete(object, key)
+		}
+	}
+	return document
+}
+
+// omission marks the array elements allowOnly didn't copy.
+type omission struct{}
+
+// allowOnly returns a copy of document holding only the values the paths
+// select, with the objects and arrays leading to them.
+func allowOnly(document any, paths []*jsonPath) any {
+	var out any
+	for _, path := range paths {
+		for _, location := range path.locations(document) {
+			out = copyAt(out, document, location)
+		}
+	}
+	if out == nil {
+		// nothing allowed was found, the document is emptied
+		switch document.(type) {
+		case map[string]any:
+			return map[string]any{}
+		case []any:
+			return []any{}
+		}
+	}
+	return compact(out)
+}
+
+// copyAt copies the value of source at location into target, creating the
+// containers on the way after those of source.
+func copyAt(target, source any, location []any) any {
+	if len(location) == 0 {
+		return source
+	}
+	switch key := location[0].(type) {
+	case string:
+		object, ok := target.(map[string]any)
+		if !ok {
+			object = map[string]any{}
+		}
+		object[key] = copyAt(object[key], source.(map[string]any)[key], location[1:])
+		return object
+	case int:
+		array, ok := target.([]any)
+		if !ok {
+			array = make([]any, len(source.([]any)))
+			for i := range array {
+				array[i] = omission{}
+			}
+		}
+		current := array[key]
+		if current == (omission{}) {
+			current = nil
+		}
+		array[key] = copyAt(current, source.([]any)[key], location[1:])
+		return array
+	}
+	return target
+}
+
+// compact drops the array elements allowOnly didn't copy.
+func compact(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, v := range value {
+			value[key] = compact(v)
+		}
+	case []any:
+		kept := value[:0]
+		for _, v := range value {
+			if v != (omission{}) {
+				kept = append(kept, compact(v))
+			}
+		}
+		return kept
+	}
+	return value
+}
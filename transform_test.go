@@ -0,0 +1,190 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResponseTransformApply(t *testing.T) {
+
+	for _, tc := range []struct {
+		transform responseTransform
+		body      string
+		want      string
+	}{
+		{
+			responseTransform{Remove: []string{"$..db_id", "$.wallet.node"}},
+			`{"db_id":1,"wallet":{"db_id":2,"name":"main","node":"http://10.0.0.7"},"items":[{"db_id":3,"amount":1.50}]}`,
+			`{"items":[{"amount":1.50}],"wallet":{"name":"main"}}`,
+		},
+		{
+			responseTransform{Rename: map[string]string{"$.wallet_id": "id", "$..tx_hash": "hash"}},
+			`{"wallet_id":"w1","txs":[{"tx_hash":"ab"},{"tx_hash":"cd"}]}`,
+			`{"id":"w1","txs":[{"hash":"ab"},{"hash":"cd"}]}`,
+		},
+		{
+			responseTransform{Allow: []string{"$.id", "$.items[*].amount", "$.wallet"}},
+			`{"id":"w1","secret":"x","items":[{"amount":1,"db_id":3},{"amount":2}],"wallet":{"name":"main"}}`,
+			`{"id":"w1","items":[{"amount":1},{"amount":2}],"wallet":{"name":"main"}}`,
+		},
+		{
+			responseTransform{Allow: []string{"$[1].id"}},
+			`[{"id":1,"x":1},{"id":2,"x":2}]`,
+			`[{"id":2}]`,
+		},
+		{
+			responseTransform{Allow: []string{"$.missing"}},
+			`{"id":"w1"}`,
+			`{}`,
+		},
+		{
+			responseTransform{Allow: []string{"$.wallet"}, Remove: []string{"$.wallet.node"}, Rename: map[string]string{"$.wallet.name": "label"}},
+			`{"wallet":{"name":"<main>","node":"n"},"other":1}`,
+			`{"wallet":{"label":"<main>"}}`,
+		},
+	} {
+		if err := tc.transform.validate(); err != nil {
+			t.Fatal(err)
+		}
+		resp := &http.Response{
+			Header: http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+			Body:   io.NopCloser(strings.NewReader(tc.body)),
+		}
+		body, length := tc.transform.body(resp)
+		got, _ := io.ReadAll(body)
+		if string(got) != tc.want || length != len(tc.want) {
+			t.Errorf("%s: got %s (%d bytes) want %s", tc.body, got, length, tc.want)
+		}
+	}
+
+}
+
+func TestResponseTransformStreams(t *testing.T) {
+
+	transform := &responseTransform{Remove: []string{"$.id"}, MaxBytes: 16}
+	if err := transform.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		contentType string
+		encoding    string
+		body        string
+	}{
+		{"text/plain", "", `{"id":1}`},
+		{"application/json", "gzip", `{"id":1}`},
+		{"application/json", "", `{"id":1,"name":"longer than the limit"}`},
+		{"application/json", "", `{"id":`},
+		{"application/json", "", `{"id":1} {"id":2}`},
+	} {
+		resp := &http.Response{
+			Header: http.Header{"Content-Type": {tc.contentType}, "Content-Encoding": {tc.encoding}},
+			Body:   io.NopCloser(strings.NewReader(tc.body)),
+		}
+		if tc.encoding == "" {
+			resp.Header.Del("Content-Encoding")
+		}
+		body, length := transform.body(resp)
+		got, _ := io.ReadAll(body)
+		if string(got) != tc.body || length != -1 {
+			t.Errorf("%s %q: got %s (%d bytes), want it unchanged", tc.contentType, tc.body, got, length)
+		}
+	}
+
+}
+
+func TestResponseTransformValidate(t *testing.T) {
+
+	for _, transform := range []*responseTransform{
+		{Allow: []string{"id"}},
+		{Remove: []string{"$["}},
+		{Rename: map[string]string{"$.items[0]": "first"}},
+		{Rename: map[string]string{"$.id": ""}},
+		{MaxBytes: -1},
+	} {
+		if err := transform.validate(); err == nil {
+			t.Errorf("%+v: invalid transform accepted", transform)
+		}
+	}
+
+}
+
+func TestRedirectResponseBody(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"v1"`)
+		body := `{"id":"w1","db_id":42,"node_url":"http://10.0.0.7:8332","balance":0.5}`
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		_, _ = w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	t.Setenv("REDIRECT_URL", ts.URL)
+	activeConfig.Store(mustProxyConfig(t, `{
+		"routes": [{
+			"name": "wallets",
+			"path": "/wallets",
+			"response_body": {"remove": ["$.db_id", "$.node_url"], "rename": {"$.id": "wallet_id"}}
+		}]
+	}`))
+	defer activeConfig.Store(nil)
+
+	rr := httptest.NewRecorder()
+	newMux().ServeHTTP(rr, httptest.NewRequest("GET", "/wallets/w1", nil))
+
+	var body map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response is not JSON: %q", rr.Body.String())
+	}
+	if len(body) != 2 || body["wallet_id"] != "w1" || body["balance"] != 0.5 {
+		t.Errorf("response not transformed: %v", body)
+	}
+	if got := rr.Header().Get("Content-Length"); got != strconv.Itoa(rr.Body.Len()) {
+		t.Errorf("got Content-Length %s for %d bytes", got, rr.Body.Len())
+	}
+	if rr.Header().Get("ETag") != "" {
+		t.Errorf("ETag of the upstream body forwarded")
+	}
+
+}
+
+func TestRedirectResponseBodyCompressed(t *testing.T) {
+
+	// the upstream compresses whenever the request takes gzip
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		body := []byte(`{"id":"w1","db_id":42}`)
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			_, _ = w.Write(body)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		_, _ = zw.Write(body)
+		_ = zw.Close()
+	}))
+	defer ts.Close()
+
+	t.Setenv("REDIRECT_URL", ts.URL)
+	activeConfig.Store(mustProxyConfig(t, `{
+		"routes": [{"name": "wallets", "path": "/wallets", "response_body": {"remove": ["$.db_id"]}}]
+	}`))
+	defer activeConfig.Store(nil)
+
+	req := httptest.NewRequest("GET", "/wallets/w1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	newMux().ServeHTTP(rr, req)
+
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != `{"id":"w1"}` {
+		t.Errorf("compressed response not transformed: %q encoded as %q", rr.Body.String(), rr.Header().Get("Content-Encoding"))
+	}
+
+}